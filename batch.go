@@ -0,0 +1,132 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchChunkSize is the number of lines a worker takes at a time.
+const batchChunkSize = 64
+
+// BatchOptions configures the batch masking.
+type BatchOptions struct {
+	Workers int    // maximum number of the workers, zero means GOMAXPROCS
+	Limits  Limits // budget of masking each line
+	MaxTime int64  // budget of the whole batch in microseconds, zero means unlimited
+}
+
+// BatchResult reports the details of a batch masking.
+type BatchResult struct {
+	Lines       []MaskResult // results of the lines, in the original order
+	Intercepted int          // number of the interrupted lines
+}
+
+// MaskLines masks the lines concurrently with a bounded number of workers.
+// Each line is masked in-place, and replaced by the returned slice of the
+// masking, as the intercept policy may change its length. Each line is
+// bounded by the per-line limits, and all lines share the context and the
+// batch time budget. The lines left when the shared budget is exhausted
+// are stopped immediately, so the intercept policy is applied to them.
+func MaskLines(ctx context.Context, lines [][]byte, opts BatchOptions) BatchResult {
+	r := BatchResult{Lines: make([]MaskResult, len(lines))}
+	if len(lines) == 0 {
+		return r
+	}
+	if opts.MaxTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(opts.MaxTime)*time.Microsecond)
+		defer cancel()
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, (len(lines)+batchChunkSize-1)/batchChunkSize)
+
+	var (
+		next        atomic.Int64
+		intercepted atomic.Int64
+		wg          sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				start := int(next.Add(batchChunkSize)) - batchChunkSize
+				if start >= len(lines) {
+					return
+				}
+				end := min(start+batchChunkSize, len(lines))
+				for j := start; j < end; j++ {
+					lines[j], r.Lines[j] = MaskEx(ctx, lines[j], opts.Limits)
+					if r.Lines[j].Reason != StopNone {
+						intercepted.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	r.Intercepted = int(intercepted.Load())
+	return r
+}
+
+// MaskBatch splits the buffer on the newlines, and masks the lines like
+// MaskLines. The buffer is masked in-place, unless the intercept policy
+// changes the length of a line, in which case a new buffer is returned.
+func MaskBatch(ctx context.Context, b []byte, opts BatchOptions) ([]byte, BatchResult) {
+	var lines [][]byte
+	for s := b; len(s) > 0; {
+		i := bytes.IndexByte(s, '\n')
+		if i < 0 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i:i])
+		s = s[i+1:]
+	}
+
+	orig := make([][]byte, len(lines))
+	copy(orig, lines)
+	r := MaskLines(ctx, lines, opts)
+
+	inPlace := true
+	for i := range lines {
+		if len(lines[i]) != len(orig[i]) || (len(lines[i]) > 0 && &lines[i][0] != &orig[i][0]) {
+			inPlace = false
+			break
+		}
+	}
+	if inPlace {
+		return b, r
+	}
+
+	out := make([]byte, 0, len(b))
+	for i, line := range lines {
+		out = append(out, line...)
+		if i < len(lines)-1 || b[len(b)-1] == '\n' {
+			out = append(out, '\n')
+		}
+	}
+	return out, r
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lvan100/go-masking"
+)
+
+func TestMaskBatch(t *testing.T) {
+	testMergeRules(t)
+	// the remainder is kept, so the scan position can be checked.
+	masking.SetInterceptPolicy(masking.InterceptKeep)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	var src, want strings.Builder
+	for i := 0; i < 1000; i++ {
+		if i%100 == 0 {
+			fmt.Fprintf(&src, "%d cell:12345678900, mobile:12345678900, phone:12345678900\n", i)
+			fmt.Fprintf(&want, "%d cell:123****8900, mobile:123****8900, phone:12345678900\n", i)
+			continue
+		}
+		fmt.Fprintf(&src, "%d cell:12345678900, mobile:12345678900\n", i)
+		fmt.Fprintf(&want, "%d cell:123****8900, mobile:123****8900\n", i)
+	}
+	src.WriteString("\nlast cell:12345678900")
+	want.WriteString("\nlast cell:123****8900")
+
+	b := []byte(src.String())
+	got, r := masking.MaskBatch(context.Background(), b, masking.BatchOptions{
+		Workers: 4,
+		Limits:  masking.Limits{MaxMatches: 2},
+	})
+	if string(got) != want.String() {
+		t.Fatalf("MaskBatch() = %s, want %s", got, want.String())
+	}
+	if &got[0] != &b[0] {
+		t.Errorf("expect masked in-place")
+	}
+	if len(r.Lines) != 1002 || r.Intercepted != 10 {
+		t.Fatalf("got %d lines, %d intercepted", len(r.Lines), r.Intercepted)
+	}
+	if r.Lines[0].Reason != masking.StopMatchLimit || r.Lines[1].Reason != masking.StopNone {
+		t.Errorf("unexpected results %+v %+v", r.Lines[0], r.Lines[1])
+	}
+	if r.Lines[1000].Reason != masking.StopNone || r.Lines[1001].Masked != 1 {
+		t.Errorf("unexpected results %+v %+v", r.Lines[1000], r.Lines[1001])
+	}
+}
+
+func TestMaskBatchIntercepted(t *testing.T) {
+	testMergeRules(t)
+
+	masking.SetInterceptPolicy(masking.InterceptReplace)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	src := "cell:12345678900\nphone:12345678900\n"
+	got, r := masking.MaskBatch(ctx, []byte(src), masking.BatchOptions{})
+	if want := "[MASKING INTERCEPTED]\n[MASKING INTERCEPTED]\n"; string(got) != want {
+		t.Errorf("MaskBatch() = %q, want %q", got, want)
+	}
+	if r.Intercepted != 2 || r.Lines[0].Reason != masking.StopCanceled {
+		t.Errorf("unexpected result %+v", r)
+	}
+
+	lines := [][]byte{[]byte("cell:12345678900"), nil, []byte("x")}
+	r = masking.MaskLines(context.Background(), lines, masking.BatchOptions{MaxTime: 1000000})
+	if !bytes.Equal(lines[0], []byte("cell:123****8900")) || lines[1] != nil || r.Intercepted != 0 {
+		t.Errorf("unexpected lines %q, result %+v", lines, r)
+	}
+}
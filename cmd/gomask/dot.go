@@ -0,0 +1,48 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/lvan100/go-masking"
+)
+
+// runDOT runs the dot subcommand, which writes the trie of the rules in
+// the Graphviz DOT language, optionally only the subtree under a prefix.
+func runDOT(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("gomask dot", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	rules := fs.String("rules", "", "rules file in JSON format (required)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gomask dot -rules rules.json [prefix]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *rules == "" || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := loadRules(*rules); err != nil {
+		fmt.Fprintf(stderr, "gomask: %v\n", err)
+		return 1
+	}
+	fmt.Fprint(stdout, masking.DumpDOT(fs.Arg(0)))
+	return 0
+}
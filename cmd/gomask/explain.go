@@ -0,0 +1,88 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/lvan100/go-masking"
+)
+
+// runExplain runs the explain subcommand, which explains why the lines
+// given by the arguments or stdin were or were not masked.
+func runExplain(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("gomask explain", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	rules := fs.String("rules", "", "rules file in JSON format (required)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gomask explain -rules rules.json [line ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *rules == "" {
+		fs.Usage()
+		return 2
+	}
+	if err := loadRules(*rules); err != nil {
+		fmt.Fprintf(stderr, "gomask: %v\n", err)
+		return 1
+	}
+
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+
+	if fs.NArg() > 0 {
+		for i, line := range fs.Args() {
+			explainLine(w, i+1, []byte(line))
+		}
+		return 0
+	}
+
+	br := bufio.NewReader(stdin)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			explainLine(w, n, bytes.TrimRight(line, "\r\n"))
+		}
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "gomask: %v\n", err)
+			return 1
+		}
+	}
+}
+
+// explainLine writes the explanations of a line.
+func explainLine(w io.Writer, n int, line []byte) {
+	fmt.Fprintf(w, "line %d: %s\n", n, line)
+	explanations := masking.Explain(line)
+	if len(explanations) == 0 {
+		fmt.Fprintln(w, "  no key candidates found in the trie")
+	}
+	for _, e := range explanations {
+		fmt.Fprintf(w, "  %s\n", e)
+	}
+	masked, _ := masking.MaskContext(context.Background(), bytes.Clone(line))
+	fmt.Fprintf(w, "  masked: %s\n", masked)
+}
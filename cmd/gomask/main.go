@@ -0,0 +1,306 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gomask masks the sensitive data in files or stdin line by line.
+//
+// Usage:
+//
+//	gomask -rules rules.json [flags] [file ...]
+//	gomask explain -rules rules.json [line ...]
+//	gomask dot -rules rules.json [prefix]
+//
+// The masked lines are written to stdout, or back to the files with -i.
+// A summary of the rule hits and the intercepted lines is printed to stderr.
+// The explain subcommand explains why the lines were or were not masked.
+// The dot subcommand writes the trie of the rules in the Graphviz DOT language.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lvan100/go-masking"
+)
+
+// batchSize is the number of lines masked by a worker at a time.
+const batchSize = 256
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// options are the command line options.
+type options struct {
+	rules   string
+	inPlace bool
+	backup  string
+	workers int
+	limits  masking.Limits
+	policy  string
+	quiet   bool
+}
+
+// policies are the intercept policies selectable by name.
+var policies = map[string]masking.InterceptPolicy{
+	"keep":     masking.InterceptKeep,
+	"redact":   masking.InterceptRedact,
+	"replace":  masking.InterceptReplace,
+	"truncate": masking.InterceptTruncate,
+}
+
+// run runs the command and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "explain" {
+		return runExplain(args[1:], stdin, stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "dot" {
+		return runDOT(args[1:], stdout, stderr)
+	}
+	fs := flag.NewFlagSet("gomask", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var opts options
+	fs.StringVar(&opts.rules, "rules", "", "rules file in JSON format (required)")
+	fs.BoolVar(&opts.inPlace, "i", false, "mask the files in-place")
+	fs.StringVar(&opts.backup, "backup", ".bak", "backup suffix of the files masked in-place, empty means no backup")
+	fs.IntVar(&opts.workers, "workers", runtime.GOMAXPROCS(0), "number of the workers masking lines in parallel")
+	fs.Int64Var(&opts.limits.MaxTime, "timeout", 0, "maximum tolerable time of masking a line in microseconds, zero means unlimited")
+	fs.IntVar(&opts.limits.MaxBytes, "max-bytes", 0, "maximum bytes scanned of a line, zero means unlimited")
+	fs.StringVar(&opts.policy, "policy", "redact", "intercept policy: keep, redact, replace or truncate")
+	fs.BoolVar(&opts.quiet, "q", false, "don't print the summary")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: gomask -rules rules.json [flags] [file ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.rules == "" {
+		fs.Usage()
+		return 2
+	}
+	if opts.inPlace && fs.NArg() == 0 {
+		fmt.Fprintln(stderr, "gomask: -i requires files")
+		return 2
+	}
+	opts.workers = max(opts.workers, 1)
+
+	policy, ok := policies[opts.policy]
+	if !ok {
+		fmt.Fprintf(stderr, "gomask: unknown policy '%s'\n", opts.policy)
+		return 2
+	}
+	masking.SetInterceptPolicy(policy)
+
+	if err := loadRules(opts.rules); err != nil {
+		fmt.Fprintf(stderr, "gomask: %v\n", err)
+		return 1
+	}
+
+	s := newSummary()
+	masking.SetObserver(s.counters)
+	defer masking.SetObserver(nil)
+
+	var err error
+	if fs.NArg() == 0 {
+		err = maskStream(stdin, stdout, opts, s)
+	} else {
+		for _, fileName := range fs.Args() {
+			if opts.inPlace {
+				err = maskFileInPlace(fileName, opts, s)
+			} else {
+				err = maskFile(fileName, stdout, opts, s)
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	if !opts.quiet {
+		s.print(stderr)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "gomask: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// maskFile masks the file and writes the masked lines to w.
+func maskFile(fileName string, w io.Writer, opts options, s *summary) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return maskStream(f, w, opts, s)
+}
+
+// maskFileInPlace masks the file and replaces it with the masked one,
+// the original file is kept with the backup suffix if not empty.
+func maskFileInPlace(fileName string, opts options, s *summary) (err error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".gomask-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err = maskFile(fileName, tmp, opts, s); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(info.Mode()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if opts.backup != "" {
+		if err = os.Rename(fileName, fileName+opts.backup); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// maskStream masks the lines read from r in parallel, and writes them to
+// w in the original order.
+func maskStream(r io.Reader, w io.Writer, opts options, s *summary) error {
+	type batch struct {
+		lines [][]byte
+		done  chan struct{}
+	}
+
+	jobs := make(chan *batch)
+	queue := make(chan *batch, opts.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				for i, line := range b.lines {
+					b.lines[i] = s.mask(line, opts.limits)
+				}
+				close(b.done)
+			}
+		}()
+	}
+
+	// reads the lines and dispatches them in batches.
+	var readErr error
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		br := bufio.NewReaderSize(r, 64*1024)
+		for {
+			b := &batch{done: make(chan struct{})}
+			for len(b.lines) < batchSize {
+				line, err := br.ReadBytes('\n')
+				if len(line) > 0 {
+					b.lines = append(b.lines, line)
+				}
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						readErr = err
+					}
+					break
+				}
+			}
+			if len(b.lines) == 0 {
+				return
+			}
+			queue <- b
+			jobs <- b
+			if len(b.lines) < batchSize {
+				return
+			}
+		}
+	}()
+
+	// writes the batches in the original order.
+	bw := bufio.NewWriterSize(w, 64*1024)
+	var writeErr error
+	for b := range queue {
+		<-b.done
+		for _, line := range b.lines {
+			if writeErr == nil {
+				_, writeErr = bw.Write(line)
+			}
+		}
+	}
+	wg.Wait()
+	if writeErr == nil {
+		writeErr = bw.Flush()
+	}
+	if readErr != nil {
+		return readErr
+	}
+	return writeErr
+}
+
+// summary collects the statistics of the masked lines.
+type summary struct {
+	counters    *masking.Counters
+	lines       atomic.Int64
+	intercepted atomic.Int64
+}
+
+func newSummary() *summary {
+	return &summary{counters: masking.NewCounters()}
+}
+
+// mask masks a line, the trailing newline is kept.
+func (s *summary) mask(line []byte, limits masking.Limits) []byte {
+	n := len(line)
+	if n > 0 && line[n-1] == '\n' {
+		n--
+	}
+	b, r := masking.MaskEx(context.Background(), line[:n], limits)
+	s.lines.Add(1)
+	if r.Reason != masking.StopNone {
+		s.intercepted.Add(1)
+	}
+	if n < len(line) {
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// print prints the summary.
+func (s *summary) print(w io.Writer) {
+	fmt.Fprintf(w, "lines: %d, intercepted: %d\n", s.lines.Load(), s.intercepted.Load())
+	snapshot := s.counters.Snapshot()
+	for _, name := range masking.RuleNames() {
+		c := snapshot.Rules[name]
+		fmt.Fprintf(w, "rule %s: %d hits, %d masked\n", name, c.Hits, c.Changed)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const rulesJSON = `{
+	"phone": {
+		"desc": "手机号",
+		"keys": ["cell", "phone", "*_phone"],
+		"length": 30,
+		"masker": "phone"
+	},
+	"id": {
+		"desc": "身份证号",
+		"keys": ["id_card"],
+		"length": 30,
+		"masker": "id"
+	}
+}`
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestRunStdin(t *testing.T) {
+	rules := writeFile(t, "rules.json", rulesJSON)
+
+	var src, want strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&src, "%d cell:12345678900, id_card:123456789012345678\n", i)
+		fmt.Fprintf(&want, "%d cell:123****8900, id_card:123456********5678\n", i)
+	}
+	src.WriteString("no newline driver_phone:12345678900")
+	want.WriteString("no newline driver_phone:123****8900")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-rules", rules, "-workers", "4"}, strings.NewReader(src.String()), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, stderr.String())
+	}
+	if stdout.String() != want.String() {
+		t.Errorf("got %s, expect %s", stdout.String(), want.String())
+	}
+	for _, s := range []string{
+		"lines: 1001, intercepted: 0",
+		"rule id: 1000 hits, 1000 masked",
+		"rule phone: 1001 hits, 1001 masked",
+	} {
+		if !strings.Contains(stderr.String(), s) {
+			t.Errorf("expect %q in summary %s", s, stderr.String())
+		}
+	}
+}
+
+func TestRunInPlace(t *testing.T) {
+	rules := writeFile(t, "rules.json", rulesJSON)
+	const src = "cell:12345678900\nphone:12345678900\n"
+	fileName := writeFile(t, "app.log", src)
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-rules", rules, "-i", "-q", fileName}, nil, &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, stderr.String())
+	}
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("unexpected output %q %q", stdout.String(), stderr.String())
+	}
+	got, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cell:123****8900\nphone:123****8900\n"; string(got) != want {
+		t.Errorf("got %q, expect %q", got, want)
+	}
+	backup, err := os.ReadFile(fileName + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != src {
+		t.Errorf("got backup %q, expect %q", backup, src)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	rules := writeFile(t, "rules.json", rulesJSON)
+	badRules := writeFile(t, "bad.json", `{"phone": {"keys": ["cell"], "masker": "unknown"}}`)
+
+	testCases := []struct {
+		args []string
+		code int
+		want string
+	}{
+		{args: nil, code: 2, want: "usage: gomask"},
+		{args: []string{"-rules", rules, "-i"}, code: 2, want: "-i requires files"},
+		{args: []string{"-rules", rules, "-policy", "x"}, code: 2, want: "unknown policy 'x'"},
+		{args: []string{"-rules", badRules}, code: 1, want: "unknown masker 'unknown' of rule 'phone'"},
+		{args: []string{"-rules", rules, "-q", "not-exist.log"}, code: 1, want: "not-exist.log"},
+	}
+	for _, tt := range testCases {
+		var stdout, stderr bytes.Buffer
+		code := run(tt.args, strings.NewReader(""), &stdout, &stderr)
+		if code != tt.code {
+			t.Errorf("%v: got exit code %d, expect %d", tt.args, code, tt.code)
+		}
+		if !strings.Contains(stderr.String(), tt.want) {
+			t.Errorf("%v: expect %q in %s", tt.args, tt.want, stderr.String())
+		}
+	}
+}
+
+func TestRunExplain(t *testing.T) {
+	rules := writeFile(t, "rules.json", rulesJSON)
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"explain", "-rules", rules}, strings.NewReader("xcell:12345678900\ncell:12345678900\n"), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, stderr.String())
+	}
+	want := `line 1: xcell:12345678900
+  key "cell" at [1,5) rule phone: rejected, no start splitter at offset 0 ('x')
+  masked: xcell:12345678900
+line 2: cell:12345678900
+  key "cell" at [0,4) rule phone: matched, both start and end splitters found; window [4,16) ":12345678900" -> ":123****8900"
+  masked: cell:123****8900
+`
+	if stdout.String() != want {
+		t.Errorf("got %s, expect %s", stdout.String(), want)
+	}
+}
+
+func TestRunDOT(t *testing.T) {
+	rules := writeFile(t, "rules.json", rulesJSON)
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"dot", "-rules", rules, "cel"}, strings.NewReader(""), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr: %s", code, stderr.String())
+	}
+	got := stdout.String()
+	if !strings.HasPrefix(got, "digraph trie {") || !strings.Contains(got, `[label="l"];`) ||
+		!strings.Contains(got, `rule phone", shape=doublecircle];`) {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/lvan100/go-masking"
+)
+
+// maskers are the built-in maskers selectable by name in the rules file.
+var maskers = map[string]masking.Masker{
+	"id":    masking.SimpleIdMasker,
+	"phone": masking.SimplePhoneMasker,
+}
+
+// ruleConfig is a rule in the rules file.
+type ruleConfig struct {
+	Desc   string   `json:"desc"`
+	Keys   []string `json:"keys"`
+	Length int      `json:"length"`
+	Masker string   `json:"masker"`
+	// Priority decides the winner of the rules matching the same key.
+	Priority int `json:"priority"`
+	// CaseSensitive makes the keys match only in their exact case.
+	CaseSensitive bool `json:"case_sensitive"`
+}
+
+// loadRules loads the rules file, which is a JSON object of rule names
+// to rules, and merges the rules.
+//
+//	{
+//	    "phone": {
+//	        "desc": "手机号",
+//	        "keys": ["cell", "phone", "*_phone"],
+//	        "length": 30,
+//	        "masker": "phone",
+//	        "priority": 1
+//	    }
+//	}
+func loadRules(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var configs map[string]ruleConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("invalid rules file '%s': %w", fileName, err)
+	}
+	rules := make(map[string]*masking.Rule)
+	for name, c := range configs {
+		m, ok := maskers[c.Masker]
+		if !ok {
+			return fmt.Errorf("unknown masker '%s' of rule '%s'", c.Masker, name)
+		}
+		rules[name] = &masking.Rule{
+			Desc:          c.Desc,
+			Keys:          c.Keys,
+			Length:        c.Length,
+			Masker:        m,
+			Priority:      c.Priority,
+			CaseSensitive: c.CaseSensitive,
+		}
+	}
+	return masking.MergeRules(rules)
+}
@@ -0,0 +1,410 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"slices"
+)
+
+// The binary format of a trie is laid out as follows, where all integers
+// are unsigned varints, and strings are prefixed with their lengths:
+//
+//	magic "GMTR", version byte
+//	extra key chars, the sorted ASCII characters allowed in keys besides
+//	    the default ones, on which the char indexes of the nodes depend
+//	rule count, rules sorted by name: name, desc, length, priority,
+//	    case-sensitive byte, key count, sorted keys
+//	node count, nodes ordered by state:
+//	    depth, variant mask byte, for each variant in the mask: the index
+//	    plus one of the case-insensitive rule, zero if none, the count of
+//	    the exact keys, exact keys: key, index of the case-sensitive rule,
+//	    child count, children: char, state
+//	crc32 (IEEE) of all the preceding bytes, 4 bytes in little endian
+//
+// Only the lowercase transition of a letter is stored, the uppercase one
+// is restored by setNextNode. The flags, rules and last terminal nodes are
+// derived from the variants of the keys, as Insert does.
+
+const (
+	trieMagic   = "GMTR"
+	trieVersion = 1
+)
+
+// ErrInvalidTrie is returned when the binary data of a trie is malformed.
+var ErrInvalidTrie = errors.New("invalid trie data")
+
+// MarshalBinary encodes the trie and the rules it references into a
+// versioned binary form. The maskers are not encoded, they are bound by
+// name when the trie is loaded.
+func (t *Trie) MarshalBinary() ([]byte, error) {
+	names := OrderedMapKeys(t.Rules)
+	index := make(map[*Rule]int, len(names))
+
+	b := make([]byte, 0, 64*len(t.Nodes))
+	b = append(b, trieMagic...)
+	b = append(b, trieVersion)
+	b = appendString(b, t.chars.extra)
+
+	b = binary.AppendUvarint(b, uint64(len(names)))
+	for i, name := range names {
+		r := t.Rules[name]
+		index[r] = i
+		b = appendString(b, name)
+		b = appendString(b, r.Desc)
+		b = binary.AppendUvarint(b, uint64(r.Length))
+		b = binary.AppendVarint(b, int64(r.Priority))
+		b = appendBool(b, r.CaseSensitive)
+		keys := slices.Clone(r.Keys)
+		slices.Sort(keys)
+		b = binary.AppendUvarint(b, uint64(len(keys)))
+		for _, k := range keys {
+			b = appendString(b, k)
+		}
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(t.Nodes)))
+	for i, n := range t.Nodes {
+		if n.State != i {
+			return nil, fmt.Errorf("node %d has state %d", i, n.State)
+		}
+		b = binary.AppendUvarint(b, uint64(n.Depth))
+		var mask byte
+		if n.variants != nil {
+			for v := range n.variants {
+				if !n.variants[v].empty() {
+					mask |= 1 << v
+				}
+			}
+		}
+		b = append(b, mask)
+		for v := 0; mask != 0 && v < len(n.variants); v++ {
+			vk := &n.variants[v]
+			if vk.empty() {
+				continue
+			}
+			j := -1
+			if vk.rule != nil {
+				var ok bool
+				if j, ok = index[vk.rule]; !ok {
+					return nil, fmt.Errorf("node %d references unknown rule '%s'", i, vk.rule.Name)
+				}
+			}
+			b = binary.AppendUvarint(b, uint64(j+1))
+			b = binary.AppendUvarint(b, uint64(len(vk.exact)))
+			for _, e := range vk.exact {
+				j, ok := index[e.rule]
+				if !ok {
+					return nil, fmt.Errorf("node %d references unknown rule '%s'", i, e.rule.Name)
+				}
+				b = appendString(b, e.key)
+				b = binary.AppendUvarint(b, uint64(j))
+			}
+		}
+		var children []CharState
+		for _, child := range n.Child {
+			for _, c := range child {
+				if c.Char < 'A' || c.Char > 'Z' {
+					children = append(children, c)
+				}
+			}
+		}
+		b = binary.AppendUvarint(b, uint64(len(children)))
+		for _, c := range children {
+			b = append(b, c.Char)
+			b = binary.AppendUvarint(b, uint64(c.State.State))
+		}
+	}
+
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// UnmarshalBinary decodes the trie from the binary form produced by
+// MarshalBinary. The rules of the decoded trie have no maskers.
+func (t *Trie) UnmarshalBinary(data []byte) error {
+	if len(data) < len(trieMagic)+1+4 || string(data[:len(trieMagic)]) != trieMagic {
+		return fmt.Errorf("%w: bad magic", ErrInvalidTrie)
+	}
+	if v := data[len(trieMagic)]; v != trieVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidTrie, v)
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidTrie)
+	}
+
+	d := &trieDecoder{b: data[len(trieMagic)+1 : n]}
+	extra := d.string()
+	chars := newKeyChars(extra)
+	if d.err == nil && chars.extra != extra {
+		d.fail("invalid extra key chars %q", extra)
+	}
+	ruleCount := d.count()
+	rules := make(map[string]*Rule, ruleCount)
+	ruleList := make([]*Rule, 0, ruleCount)
+	for i := 0; i < ruleCount && d.err == nil; i++ {
+		r := &Rule{Name: d.string(), Desc: d.string(), Length: d.int(), Priority: d.varint(), CaseSensitive: d.bool()}
+		keyCount := d.count()
+		for j := 0; j < keyCount && d.err == nil; j++ {
+			r.Keys = append(r.Keys, d.string())
+		}
+		slices.Sort(r.Keys)
+		if _, ok := rules[r.Name]; ok {
+			d.fail("duplicate rule '%s'", r.Name)
+		}
+		rules[r.Name] = r
+		ruleList = append(ruleList, r)
+	}
+
+	type childRef struct {
+		char  uint8
+		state int
+	}
+	nodeCount := d.count()
+	if d.err == nil && nodeCount == 0 {
+		d.fail("no root node")
+	}
+	nodes := make([]*TrieNode, 0, nodeCount)
+	children := make([][]childRef, 0, nodeCount)
+	for i := 0; i < nodeCount && d.err == nil; i++ {
+		node := &TrieNode{State: i, Depth: d.int()}
+		mask := d.byte()
+		if mask >= 1<<4 {
+			d.fail("node %d has variant mask %d", i, mask)
+		} else if mask != 0 {
+			node.variants = new([4]variantKeys)
+		}
+		for v := 0; v < 4 && mask != 0 && d.err == nil; v++ {
+			if mask&(1<<v) == 0 {
+				continue
+			}
+			vk := &node.variants[v]
+			if j := d.int(); j > len(ruleList) {
+				d.fail("node %d references rule %d", i, j-1)
+				break
+			} else if j > 0 {
+				if vk.rule = ruleList[j-1]; vk.rule.CaseSensitive {
+					d.fail("node %d has case-sensitive rule '%s' for all cases", i, vk.rule.Name)
+				}
+			}
+			keyCount := d.count()
+			for k := 0; k < keyCount && d.err == nil; k++ {
+				s, j := d.string(), d.int()
+				switch {
+				case j >= len(ruleList):
+					d.fail("node %d references rule %d", i, j)
+				case !ruleList[j].CaseSensitive:
+					d.fail("node %d has exact key %q of case-insensitive rule '%s'", i, s, ruleList[j].Name)
+				case len(s) != node.Depth || vk.indexExact(s) >= 0:
+					d.fail("node %d has exact key %q", i, s)
+				default:
+					vk.exact = append(vk.exact, exactKey{s, ruleList[j]})
+				}
+			}
+			if d.err == nil && vk.empty() {
+				d.fail("node %d has empty variant %d", i, v)
+			}
+		}
+		node.updateEnd()
+		var refs []childRef
+		childCount := d.count()
+		for j := 0; j < childCount && d.err == nil; j++ {
+			refs = append(refs, childRef{d.byte(), d.int()})
+		}
+		nodes = append(nodes, node)
+		children = append(children, refs)
+	}
+	if d.err == nil && len(d.b) > 0 {
+		d.fail("%d trailing bytes", len(d.b))
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	// links the nodes, each node except the root has exactly one parent.
+	u := &Trie{chars: chars}
+	linked := make([]bool, len(nodes))
+	for i, node := range nodes {
+		for _, c := range children[i] {
+			if !chars.isKeyChar(c.char) || (c.char >= 'A' && c.char <= 'Z') {
+				return fmt.Errorf("%w: node %d has invalid char %d", ErrInvalidTrie, i, c.char)
+			}
+			if c.state <= 0 || c.state >= len(nodes) || linked[c.state] {
+				return fmt.Errorf("%w: node %d has invalid child %d", ErrInvalidTrie, i, c.state)
+			}
+			if u.getNextNode(node, c.char) != nil {
+				return fmt.Errorf("%w: node %d has duplicate char %q", ErrInvalidTrie, i, c.char)
+			}
+			child := nodes[c.state]
+			if child.Depth != node.Depth+1 {
+				return fmt.Errorf("%w: node %d has depth %d", ErrInvalidTrie, c.state, child.Depth)
+			}
+			linked[c.state] = true
+			u.setNextNode(node, c.char, child)
+		}
+	}
+	if nodes[0].Depth != 0 {
+		return fmt.Errorf("%w: root node has depth %d", ErrInvalidTrie, nodes[0].Depth)
+	}
+	maxDepth := 0
+	for i, node := range nodes {
+		if i > 0 && !linked[i] {
+			return fmt.Errorf("%w: node %d is unreachable", ErrInvalidTrie, i)
+		}
+		maxDepth = max(maxDepth, node.Depth)
+	}
+	depths := make([]int, maxDepth+1)
+	for _, node := range nodes {
+		depths[node.Depth]++
+		if node.End {
+			setLastEnd(node, node)
+		}
+	}
+
+	*t = Trie{Nodes: nodes, Trie: nodes[0], MaxDepth: maxDepth, Rules: rules, depths: depths, chars: chars, allStale: true}
+	t.updatePriority()
+	t.updatePreferred()
+	return nil
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// trieDecoder reads the fields of a trie, and records the first error.
+type trieDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *trieDecoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: "+format, append([]any{ErrInvalidTrie}, args...)...)
+	}
+}
+
+func (d *trieDecoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > math.MaxInt32 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return int(v)
+}
+
+// varint reads a signed number.
+func (d *trieDecoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 || v > math.MaxInt32 || v < math.MinInt32 {
+		d.fail("bad varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return int(v)
+}
+
+// count reads the number of the following items, each of which takes
+// at least one byte, so a corrupted count can't cause a huge allocation.
+func (d *trieDecoder) count() int {
+	v := d.int()
+	if v > len(d.b) {
+		d.fail("count %d exceeds data", v)
+		return 0
+	}
+	return v
+}
+
+func (d *trieDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *trieDecoder) bool() bool {
+	switch c := d.byte(); c {
+	case 0, 1:
+		return c == 1
+	default:
+		d.fail("bad bool %d", c)
+		return false
+	}
+}
+
+func (d *trieDecoder) string() string {
+	n := d.count()
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// LoadTrie replaces the rules and the trie with the ones decoded from the
+// binary form produced by MarshalTrie, and binds the rules to the maskers
+// by name. Every rule must have a masker, and the trie must allow the same
+// extra key characters as the current one.
+func LoadTrie(data []byte, maskers map[string]Masker) error {
+	t := &Trie{}
+	if err := t.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	for _, name := range OrderedMapKeys(t.Rules) {
+		m, ok := maskers[name]
+		if !ok || m == nil {
+			return fmt.Errorf("no masker for rule '%s'", name)
+		}
+		t.Rules[name].Masker = m
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+	if extra := cfg.Load().chars.extra; t.chars.extra != extra {
+		return fmt.Errorf("trie has extra key chars %q, but %q are set", t.chars.extra, extra)
+	}
+	cfg.Store(t)
+	return nil
+}
+
+// MarshalTrie encodes the current trie and rules into a versioned binary
+// form, which can be loaded by LoadTrie without reconstructing the trie.
+func MarshalTrie() ([]byte, error) {
+	return cfg.Load().MarshalBinary()
+}
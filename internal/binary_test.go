@@ -0,0 +1,226 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func testRules() map[string]*Rule {
+	return map[string]*Rule{
+		"phone": {
+			Name:   "phone",
+			Desc:   "手机号",
+			Length: 30,
+			Keys:   []string{"phone", "phone1", "mobile", "*_suffix_p", "p_prefix_*", "*_content_*"},
+			Masker: func(b []byte) {},
+		},
+		"id": {
+			Name:     "id",
+			Length:   20,
+			Keys:     []string{"id", "id_no", "id-card@v2"},
+			Masker:   func(b []byte) {},
+			Priority: -1,
+		},
+	}
+}
+
+// equalTrie reports whether two tries have the same structure.
+func equalTrie(t *testing.T, got, want *Trie) {
+	t.Helper()
+	if len(got.Nodes) != len(want.Nodes) || got.MaxDepth != want.MaxDepth {
+		t.Fatalf("got %d nodes depth %d, expect %d nodes depth %d",
+			len(got.Nodes), got.MaxDepth, len(want.Nodes), want.MaxDepth)
+	}
+	if !slices.Equal(OrderedMapKeys(got.Rules), OrderedMapKeys(want.Rules)) {
+		t.Fatalf("got rules %v, expect %v", OrderedMapKeys(got.Rules), OrderedMapKeys(want.Rules))
+	}
+	for i, n := range want.Nodes {
+		g := got.Nodes[i]
+		if g.State != n.State || g.Depth != n.Depth || g.End != n.End ||
+			g.AnyStart != n.AnyStart || g.AnyEnd != n.AnyEnd || g.ChildBitMap != n.ChildBitMap {
+			t.Fatalf("node %d: got %+v, expect %+v", i, g, n)
+		}
+		if (g.Rule == nil) != (n.Rule == nil) || (g.Rule != nil && g.Rule.Name != n.Rule.Name) {
+			t.Fatalf("node %d: got rule %v, expect %v", i, g.Rule, n.Rule)
+		}
+		if (g.LastEnd == nil) != (n.LastEnd == nil) || (g.LastEnd != nil && g.LastEnd.State != n.LastEnd.State) {
+			t.Fatalf("node %d: got last end %v, expect %v", i, g.LastEnd, n.LastEnd)
+		}
+		for s := range n.Child {
+			if len(g.Child[s]) != len(n.Child[s]) {
+				t.Fatalf("node %d: got children %v, expect %v", i, g.Child[s], n.Child[s])
+			}
+			for j, c := range n.Child[s] {
+				if g.Child[s][j].Char != c.Char || g.Child[s][j].State.State != c.State.State {
+					t.Fatalf("node %d: got children %v, expect %v", i, g.Child[s], n.Child[s])
+				}
+			}
+		}
+	}
+}
+
+func TestTrieBinary(t *testing.T) {
+	want := ConstructTrie(testRules())
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := &Trie{}
+	if err = got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	equalTrie(t, got, want)
+	if !slices.Equal(got.DumpTrie(), want.DumpTrie()) {
+		t.Fatalf("got %v, expect %v", got.DumpTrie(), want.DumpTrie())
+	}
+	r := got.Rules["phone"]
+	if r.Desc != "手机号" || r.Length != 30 || len(r.Keys) != 6 || r.Masker != nil {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+	if r = got.Rules["id"]; r.Priority != -1 {
+		t.Fatalf("got priority %d, expect -1", r.Priority)
+	}
+
+	src := []byte("PHONE:1, id-card@v2:2, user_suffix_p:3, x_content_y:4, p_prefix_abc:5")
+	gotPos, _, _ := got.Match(src, DefaultKeyFilter, NewContextBudget(context.Background()))
+	wantPos, _, _ := want.Match(src, DefaultKeyFilter, NewContextBudget(context.Background()))
+	if len(gotPos) != 5 || len(gotPos) != len(wantPos) {
+		t.Fatalf("got %v, expect %v", gotPos, wantPos)
+	}
+	for i := range wantPos {
+		g, w := gotPos[i], wantPos[i]
+		if g.Start != w.Start || g.End != w.End || g.Rule.Name != w.Rule.Name {
+			t.Fatalf("got %v, expect %v", gotPos, wantPos)
+		}
+	}
+
+	again, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(again, data) {
+		t.Fatal("expect the same data after a round trip")
+	}
+
+	// the extra key chars are restored with the trie.
+	rules := map[string]*Rule{"r": {Name: "r", Keys: []string{"user.phone", "a[0]"}}}
+	want = constructTrie(rules, newKeyChars("[.]"))
+	if data, err = want.MarshalBinary(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got = &Trie{}
+	if err = got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	equalTrie(t, got, want)
+	if got.chars.extra != ".[]" || got.Lookup("user.phone") == nil {
+		t.Fatalf("got extra key chars %q, keys %v", got.chars.extra, got.DumpTrie())
+	}
+}
+
+func TestTrieBinaryInvalid(t *testing.T) {
+	data, err := ConstructTrie(testRules()).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(slices.Clone(data))
+	}
+	// checksum recomputes the checksum of the corrupted data.
+	checksum := func(b []byte) []byte {
+		n := len(b) - 4
+		binary.LittleEndian.PutUint32(b[n:], crc32.ChecksumIEEE(b[:n]))
+		return b
+	}
+	testCases := map[string][]byte{
+		"empty":     nil,
+		"magic":     corrupt(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"version":   corrupt(func(b []byte) []byte { b[4] = 99; return b }),
+		"checksum":  corrupt(func(b []byte) []byte { b[len(b)/2]++; return b }),
+		"truncated": corrupt(func(b []byte) []byte { return b[:len(b)-1] }),
+		"chars":     corrupt(func(b []byte) []byte { return checksum(slices.Replace(b, 5, 6, 1, '*')) }),
+	}
+	for name, b := range testCases {
+		err := (&Trie{}).UnmarshalBinary(b)
+		if !errors.Is(err, ErrInvalidTrie) {
+			t.Errorf("%s: got error %v, expect %v", name, err, ErrInvalidTrie)
+		}
+	}
+}
+
+func TestLoadTrie(t *testing.T) {
+	defer cfg.Store(NewTrie(nil))
+
+	data, err := ConstructTrie(testRules()).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	maskers := map[string]Masker{
+		"phone": func(b []byte) { redact(b) },
+	}
+	err = LoadTrie(data, maskers)
+	if err == nil || err.Error() != "no masker for rule 'id'" {
+		t.Fatalf("got error %v, expect no masker for rule 'id'", err)
+	}
+	if len(cfg.Load().Rules) != 0 {
+		t.Fatal("expect the trie unchanged on error")
+	}
+
+	maskers["id"] = func(b []byte) { redact(b) }
+	if err = LoadTrie(data, maskers); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(RuleNames(), []string{"id", "phone"}) {
+		t.Fatalf("got rules %v", RuleNames())
+	}
+	b, intercepted := Mask([]byte("id:1234 mobile:56"), 1e9)
+	if intercepted || string(b) != "id***************" {
+		t.Fatalf("got %s %v", b, intercepted)
+	}
+
+	// the trie must allow the same extra key chars.
+	rules := map[string]*Rule{"r": {Name: "r", Keys: []string{"user.phone"}}}
+	dotted, err := constructTrie(rules, newKeyChars(".")).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	maskers["r"] = func(b []byte) { redact(b) }
+	err = LoadTrie(dotted, maskers)
+	if err == nil || err.Error() != `trie has extra key chars ".", but "" are set` {
+		t.Fatalf("got error %v, expect the extra key chars mismatch", err)
+	}
+	if !slices.Equal(RuleNames(), []string{"id", "phone"}) {
+		t.Fatalf("got rules %v", RuleNames())
+	}
+
+	// merges more rules into the loaded ones.
+	err = MergeRules(map[string]*Rule{"id": {Keys: []string{"ID_CARD"}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := DumpTrie(); !slices.Contains(keys, "id_card") || !slices.Contains(keys, "mobile") {
+		t.Fatalf("got %v", keys)
+	}
+}
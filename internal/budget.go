@@ -0,0 +1,132 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// StopReason describes why a masking operation stopped.
+type StopReason int
+
+const (
+	StopNone       StopReason = iota // the whole input was processed
+	StopDeadline                     // the time budget or deadline was exceeded
+	StopCanceled                     // the context was canceled
+	StopPanic                        // a panic occurred during the operation
+	StopByteLimit                    // the maximum bytes to scan was reached
+	StopMatchLimit                   // the maximum matches to find was reached
+)
+
+// String returns the name of the stop reason.
+func (r StopReason) String() string {
+	switch r {
+	case StopNone:
+		return "none"
+	case StopDeadline:
+		return "deadline"
+	case StopCanceled:
+		return "canceled"
+	case StopPanic:
+		return "panic"
+	case StopByteLimit:
+		return "byte-limit"
+	case StopMatchLimit:
+		return "match-limit"
+	default:
+		return "unknown"
+	}
+}
+
+// Limits defines the budget of a masking operation. The byte and match
+// limits are deterministic, so the operation always stops at the same
+// point for the same input, unlike the time limit.
+type Limits struct {
+	MaxTime    int64 // maximum tolerable time in microseconds, zero means unlimited
+	MaxBytes   int   // maximum bytes to scan, zero means unlimited
+	MaxMatches int   // maximum matches to find, zero means unlimited
+}
+
+// Budget limits the time and the amount of work a masking operation may take.
+type Budget struct {
+	done    <-chan struct{}
+	err     func() error
+	clock   Clock
+	start   int64
+	maxTime int64 // in microseconds
+	limited bool  // whether maxTime is effective
+
+	maxBytes   int // zero means unlimited
+	maxMatches int // zero means unlimited
+}
+
+// NewBudget returns a budget bounded by the context and the maximum
+// tolerable time in microseconds.
+func NewBudget(ctx context.Context, maxTime int64) *Budget {
+	b := NewContextBudget(ctx)
+	if !b.limited || maxTime < b.maxTime {
+		b.maxTime = maxTime
+		b.limited = true
+	}
+	return b
+}
+
+// NewLimitsBudget returns a budget bounded by the context and the limits.
+func NewLimitsBudget(ctx context.Context, l Limits) *Budget {
+	b := NewContextBudget(ctx)
+	if l.MaxTime > 0 && (!b.limited || l.MaxTime < b.maxTime) {
+		b.maxTime = l.MaxTime
+		b.limited = true
+	}
+	b.maxBytes = max(l.MaxBytes, 0)
+	b.maxMatches = max(l.MaxMatches, 0)
+	return b
+}
+
+// NewContextBudget returns a budget bounded only by the context.
+func NewContextBudget(ctx context.Context) *Budget {
+	c := clock
+	b := &Budget{
+		done:  ctx.Done(),
+		err:   ctx.Err,
+		clock: c,
+		start: c.MicroNow(),
+	}
+	if d, ok := ctx.Deadline(); ok {
+		b.maxTime = max(time.Until(d).Microseconds(), 0)
+		b.limited = true
+	}
+	return b
+}
+
+// Check reports whether the budget has been exhausted and why.
+func (b *Budget) Check() StopReason {
+	if b.done != nil {
+		select {
+		case <-b.done:
+			if errors.Is(b.err(), context.Canceled) {
+				return StopCanceled
+			}
+			return StopDeadline
+		default:
+		}
+	}
+	if b.limited && b.clock.MicroNow()-b.start > b.maxTime {
+		return StopDeadline
+	}
+	return StopNone
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock provides the current time for measuring the masking budget.
+type Clock interface {
+	// MicroNow returns the current timestamp in microseconds.
+	MicroNow() int64
+}
+
+// DefaultClock is the clock used by default, it updates the cached
+// timestamp every one millisecond.
+var DefaultClock = NewCoarseClock(time.Millisecond)
+
+// clock is the clock used to measure the masking budget.
+var clock Clock = DefaultClock
+
+// SetClock sets the clock used to measure the masking budget.
+func SetClock(c Clock) {
+	clock = c
+}
+
+// StopClock stops the background goroutine of the current clock, if any.
+func StopClock() {
+	if c, ok := clock.(interface{ Stop() }); ok {
+		c.Stop()
+	}
+}
+
+// SystemClock is a clock that reads the monotonic clock directly.
+type SystemClock struct{}
+
+// epoch is the process start time, it carries a monotonic clock reading.
+var epoch = time.Now()
+
+// MicroNow returns the time elapsed since the process started in microseconds.
+func (SystemClock) MicroNow() int64 {
+	return time.Since(epoch).Microseconds()
+}
+
+// FakeClock is a clock for deterministic tests. It only moves forward
+// when Advance is called, or by step microseconds every time it is read.
+type FakeClock struct {
+	now  atomic.Int64
+	step int64
+}
+
+// NewFakeClock returns a fake clock starting at start, which moves forward
+// step microseconds every time it is read.
+func NewFakeClock(start int64, step int64) *FakeClock {
+	c := &FakeClock{step: step}
+	c.now.Store(start)
+	return c
+}
+
+// MicroNow returns the current fake timestamp in microseconds.
+func (c *FakeClock) MicroNow() int64 {
+	return c.now.Add(c.step) - c.step
+}
+
+// Advance moves the fake clock forward.
+func (c *FakeClock) Advance(micros int64) {
+	c.now.Add(micros)
+}
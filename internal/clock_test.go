@@ -0,0 +1,59 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoarseClock(t *testing.T) {
+	c := NewCoarseClock(time.Millisecond)
+	if c.running.Load() {
+		t.Fatal("expect not running before the first use")
+	}
+	t1 := c.MicroNow()
+	if !c.running.Load() {
+		t.Fatal("expect running after the first use")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if t2 := c.MicroNow(); t2 <= t1 {
+		t.Fatalf("expect %d > %d", t2, t1)
+	}
+	c.Stop()
+	if c.running.Load() {
+		t.Fatal("expect not running after stop")
+	}
+	c.Stop()
+	c.MicroNow()
+	if !c.running.Load() {
+		t.Fatal("expect running after restart")
+	}
+	c.Stop()
+}
+
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock(100, 10)
+	if got := c.MicroNow(); got != 100 {
+		t.Fatalf("got %d, expect 100", got)
+	}
+	if got := c.MicroNow(); got != 110 {
+		t.Fatalf("got %d, expect 110", got)
+	}
+	c.Advance(1000)
+	if got := c.MicroNow(); got != 1120 {
+		t.Fatalf("got %d, expect 1120", got)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DumpDOT renders the trie in the Graphviz DOT language. Each node shows
+// its state and depth, and a terminal node also shows its flags and rule,
+// with the priority of the rule if it's not zero.
+// The LastEnd pointers are rendered as dashed edges. If prefix is not
+// empty, only the subtree under the prefix and the path to it are rendered.
+func (t *Trie) DumpDOT(prefix string) string {
+	var sb strings.Builder
+	sb.WriteString("digraph trie {\n")
+	sb.WriteString("\tnode [shape=circle];\n")
+
+	n := t.Trie
+	writeDOTNode(&sb, n)
+	for i := 0; i < len(prefix); i++ {
+		next := t.getNextNode(n, prefix[i])
+		if next == nil {
+			sb.WriteString("}\n")
+			return sb.String()
+		}
+		writeDOTNode(&sb, next)
+		writeDOTEdge(&sb, n, next, dotChar(lowerKey(prefix)[i]))
+		n = next
+	}
+	writeDOTSubtree(&sb, n)
+
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// writeDOTSubtree renders the descendants of the node in the order of chars.
+func writeDOTSubtree(sb *strings.Builder, n *TrieNode) {
+	var children []CharState
+	for _, child := range n.Child {
+		for _, c := range child {
+			if c.Char < 'A' || c.Char > 'Z' { // the uppercase shares the node
+				children = append(children, c)
+			}
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Char < children[j].Char
+	})
+	for _, c := range children {
+		writeDOTNode(sb, c.State)
+		writeDOTEdge(sb, n, c.State, dotChar(c.Char))
+		writeDOTSubtree(sb, c.State)
+	}
+}
+
+func writeDOTNode(sb *strings.Builder, n *TrieNode) {
+	label := fmt.Sprintf("%d\ndepth %d", n.State, n.Depth)
+	shape := ""
+	if n.End {
+		flags := []string{"end"}
+		if n.AnyStart {
+			flags = append(flags, "any-start")
+		}
+		if n.AnyEnd {
+			flags = append(flags, "any-end")
+		}
+		if n.Rule != nil && n.Rule.CaseSensitive {
+			flags = append(flags, "case-sensitive")
+		}
+		label += "\n" + strings.Join(flags, ",")
+		if n.Rule != nil {
+			label += "\nrule " + n.Rule.Name
+			if n.Rule.Priority != 0 {
+				label += fmt.Sprintf("\npriority %d", n.Rule.Priority)
+			}
+		}
+		shape = ", shape=doublecircle"
+	}
+	fmt.Fprintf(sb, "\tn%d [label=%q%s];\n", n.State, label, shape)
+	if n.LastEnd != nil {
+		fmt.Fprintf(sb, "\tn%d -> n%d [style=dashed];\n", n.State, n.LastEnd.State)
+	}
+}
+
+// dotChar returns the edge label of the char, a non-ASCII byte of a UTF-8
+// key is labeled in hex.
+func dotChar(c uint8) string {
+	if c >= utf8.RuneSelf {
+		return fmt.Sprintf("0x%02x", c)
+	}
+	return string(rune(c))
+}
+
+func writeDOTEdge(sb *strings.Builder, from, to *TrieNode, c string) {
+	fmt.Fprintf(sb, "\tn%d -> n%d [label=%q];\n", from.State, to.State, c)
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestDumpDOT(t *testing.T) {
+	trie := ConstructTrie(map[string]*Rule{
+		"phone": {Name: "phone", Keys: []string{"cell", "cell_*", "*_no"}},
+	})
+
+	testCases := []struct {
+		prefix string
+		want   string
+	}{
+		{
+			prefix: "",
+			want: `digraph trie {
+	node [shape=circle];
+	n0 [label="0\ndepth 0"];
+	n1 [label="1\ndepth 1"];
+	n0 -> n1 [label="_"];
+	n2 [label="2\ndepth 2"];
+	n1 -> n2 [label="n"];
+	n3 [label="3\ndepth 3\nend,any-start\nrule phone", shape=doublecircle];
+	n2 -> n3 [label="o"];
+	n4 [label="4\ndepth 1"];
+	n0 -> n4 [label="c"];
+	n5 [label="5\ndepth 2"];
+	n4 -> n5 [label="e"];
+	n6 [label="6\ndepth 3"];
+	n5 -> n6 [label="l"];
+	n7 [label="7\ndepth 4\nend\nrule phone", shape=doublecircle];
+	n6 -> n7 [label="l"];
+	n8 [label="8\ndepth 5\nend,any-end\nrule phone", shape=doublecircle];
+	n8 -> n7 [style=dashed];
+	n7 -> n8 [label="_"];
+}
+`,
+		},
+		{
+			prefix: "CELL_",
+			want: `digraph trie {
+	node [shape=circle];
+	n0 [label="0\ndepth 0"];
+	n4 [label="4\ndepth 1"];
+	n0 -> n4 [label="c"];
+	n5 [label="5\ndepth 2"];
+	n4 -> n5 [label="e"];
+	n6 [label="6\ndepth 3"];
+	n5 -> n6 [label="l"];
+	n7 [label="7\ndepth 4\nend\nrule phone", shape=doublecircle];
+	n6 -> n7 [label="l"];
+	n8 [label="8\ndepth 5\nend,any-end\nrule phone", shape=doublecircle];
+	n8 -> n7 [style=dashed];
+	n7 -> n8 [label="_"];
+}
+`,
+		},
+		{
+			prefix: "x",
+			want: `digraph trie {
+	node [shape=circle];
+	n0 [label="0\ndepth 0"];
+}
+`,
+		},
+	}
+	for _, c := range testCases {
+		if got := trie.DumpDOT(c.prefix); got != c.want {
+			t.Errorf("DumpDOT(%q) = %s, want %s", c.prefix, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Explanation describes a key candidate found by the trie walk, that is,
+// where the walk stopped inside the trie, and why it was or was not masked.
+// The spans are half-open.
+type Explanation struct {
+	KeyStart    int    // start of the candidate key
+	KeyEnd      int    // end of the candidate key
+	Key         string // the candidate key, or the key taking precedence over it
+	Rule        string // name of the matched rule, empty if no rule
+	Matched     bool   // whether the candidate is accepted
+	Reason      string // why the candidate is accepted or rejected
+	WindowStart int    // start of the bytes handed to the masker
+	WindowEnd   int    // end of the bytes handed to the masker
+	Before      string // the bytes handed to the masker
+	After       string // the bytes after the masker is applied
+}
+
+// String returns a human-readable description of the explanation.
+func (e Explanation) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "key %q at [%d,%d)", e.Key, e.KeyStart, e.KeyEnd)
+	if e.Rule != "" {
+		fmt.Fprintf(&sb, " rule %s", e.Rule)
+	}
+	if !e.Matched {
+		fmt.Fprintf(&sb, ": rejected, %s", e.Reason)
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, ": matched, %s", e.Reason)
+	fmt.Fprintf(&sb, "; window [%d,%d) %q", e.WindowStart, e.WindowEnd, e.Before)
+	if e.Before == e.After {
+		sb.WriteString(" unchanged by the masker")
+	} else {
+		fmt.Fprintf(&sb, " -> %q", e.After)
+	}
+	return sb.String()
+}
+
+// Explain traces the trie walk over the byte slice without modifying it,
+// and explains each key candidate. The maskers are applied on a copy in
+// the same order as Mask does.
+func Explain(b []byte) []Explanation {
+	t := cfg.Load()
+	if len(t.Rules) == 0 {
+		return nil
+	}
+
+	var (
+		result    []Explanation
+		positions []Position
+		indexes   []int // index of the explanation of each position
+	)
+
+	budget := NewContextBudget(context.Background())
+	trace := func(s MatchStep) {
+		if s.Matched {
+			positions = append(positions, s.Match)
+			indexes = append(indexes, len(result))
+		}
+		result = append(result, explainStep(b, s))
+	}
+	_, _ = t.MatchFunc(b, keyFilter, budget, trace, func(Position) bool { return true })
+
+	// applies the maskers on a copy in the same order as Mask.
+	resolveWindows(positions, len(b))
+	c := append([]byte(nil), b...)
+	forEachMaskOrder(positions, func(i int) bool {
+		p := positions[i]
+		e := &result[indexes[i]]
+		w := valueWindow(c, p)
+		e.WindowStart = p.WinStart
+		e.WindowEnd = p.WinEnd
+		e.Before = string(w)
+		if mp := applyMasker(p.Rule, w); mp != nil {
+			e.Reason += fmt.Sprintf(", but the masker panicked: %v", mp.Value)
+		}
+		e.After = string(w)
+		return true
+	})
+	return result
+}
+
+// explainStep explains the verdict of the key candidate of the walk.
+func explainStep(b []byte, s MatchStep) Explanation {
+	if s.End {
+		start := s.Pos - s.Node.Depth + 1
+		return Explanation{
+			KeyStart: start,
+			KeyEnd:   s.Pos + 1,
+			Key:      string(b[start : s.Pos+1]),
+			Reason:   "the walk reached the end of input, a key must be followed by a splitter",
+		}
+	}
+	e := explainMatch(b, s.Node, s.Pos)
+	if s.Preferred {
+		q := s.Match
+		e.KeyStart, e.KeyEnd, e.Key = q.Start, q.End+1, string(b[q.Start:q.End+1])
+		e.Reason = fmt.Sprintf("key %q of rule %s takes precedence with priority %d", e.Key, q.Rule.Name, q.Rule.Priority)
+		e.Rule, e.Matched = q.Rule.Name, true
+	}
+	return e
+}
+
+// explainMatch is like testMatch, but it explains the verdict.
+func explainMatch(b []byte, c *TrieNode, pos int) Explanation {
+	e := Explanation{
+		KeyStart: pos - c.Depth + 1,
+		KeyEnd:   pos + 1,
+		Key:      string(b[pos-c.Depth+1 : pos+1]),
+	}
+
+	// caseMismatch explains a key differing in case from the keys of the
+	// case-sensitive rule of the node.
+	caseMismatch := func(n *TrieNode) Explanation {
+		e.Rule = n.Rule.Name
+		e.Reason = fmt.Sprintf("the key differs in case from the keys of the case-sensitive rule %s", n.Rule.Name)
+		return e
+	}
+
+	n, need := c, 0
+	var rule *Rule
+	var variant int
+	if c.End {
+		rule, variant = c.owner(b[e.KeyStart:e.KeyEnd], 0)
+	}
+	if rule == nil { // must be a prefix match.
+		n, need = c.LastEnd, variantAnyEnd
+		if c.End && (n == nil || !n.AnyEnd) {
+			return caseMismatch(c)
+		}
+		if n == nil {
+			e.Reason = fmt.Sprintf("the walk stopped at offset %d, no key is a prefix of it", pos+1)
+			return e
+		}
+		prefix := e.Key[:n.Depth]
+		if !n.AnyEnd {
+			e.Rule = n.Rule.Name
+			e.Reason = fmt.Sprintf("the walk stopped at offset %d, the prefix key %q has no end wildcard", pos+1, prefix)
+			return e
+		}
+		e.Key = prefix
+		e.KeyEnd = e.KeyStart + n.Depth
+		if rule, variant = n.owner(b[e.KeyStart:e.KeyEnd], need); rule == nil {
+			return caseMismatch(n)
+		}
+	}
+
+	start, end := e.KeyStart, e.KeyEnd-1
+	if r, v := n.match(b, start, end, keyFilter, need); r != nil {
+		rule, variant = r, v
+		e.Matched = true
+	}
+	e.Rule = rule.Name
+	anyStart, anyEnd := variant&variantAnyStart != 0, variant&variantAnyEnd != 0
+	if customKeyFilter {
+		e.Reason = "rejected by the custom key filter"
+		if e.Matched {
+			e.Reason = "accepted by the custom key filter"
+		}
+		return e
+	}
+
+	if !startSplitter(b, start, anyStart) {
+		r, size := utf8.DecodeLastRune(b[:start])
+		e.Reason = fmt.Sprintf("no start splitter at offset %d (%s)", start-size, quoteRune(r, b[start-1]))
+		return e
+	}
+	if !endSplitter(b, end, anyEnd) {
+		r, _ := utf8.DecodeRune(b[end+1:])
+		e.Reason = fmt.Sprintf("no end splitter at offset %d (%s)", end+1, quoteRune(r, b[end+1]))
+		return e
+	}
+	e.Reason = "both start and end splitters found"
+	if anyStart || anyEnd {
+		e.Reason = "wildcard key " + ParsedKey{e.Key, anyStart, anyEnd}.Key() + " matched"
+	}
+	return e
+}
+
+// quoteRune quotes a character for the human-readable explanation, or the
+// byte c if it's not a valid UTF-8 character.
+func quoteRune(r rune, c byte) string {
+	if r != utf8.RuneError {
+		return strconv.QuoteRune(r)
+	}
+	return quoteByte(c)
+}
+
+// quoteByte quotes a byte for the human-readable explanation.
+func quoteByte(c byte) string {
+	if c < 0x80 {
+		return strconv.QuoteRune(rune(c))
+	}
+	return fmt.Sprintf("0x%02x", c)
+}
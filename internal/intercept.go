@@ -0,0 +1,86 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// InterceptPolicy defines how the unscanned remainder is handled when
+// a masking operation is interrupted.
+type InterceptPolicy int
+
+const (
+	InterceptKeep     InterceptPolicy = iota // leaves the remainder as is
+	InterceptRedact                          // redacts the remainder with '*'
+	InterceptReplace                         // replaces the whole slice with the placeholder
+	InterceptTruncate                        // truncates the slice at the scan position
+)
+
+// String returns the name of the intercept policy.
+func (p InterceptPolicy) String() string {
+	switch p {
+	case InterceptKeep:
+		return "keep"
+	case InterceptRedact:
+		return "redact"
+	case InterceptReplace:
+		return "replace"
+	case InterceptTruncate:
+		return "truncate"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	interceptPolicy      = InterceptRedact
+	interceptPlaceholder = []byte("[MASKING INTERCEPTED]")
+)
+
+// SetInterceptPolicy sets the intercept policy.
+func SetInterceptPolicy(p InterceptPolicy) {
+	interceptPolicy = p
+}
+
+// SetInterceptPlaceholder sets the placeholder used by InterceptReplace.
+func SetInterceptPlaceholder(s string) {
+	interceptPlaceholder = []byte(s)
+}
+
+// intercept applies the intercept policy to the byte slice, of which the
+// bytes after pos are not scanned. Newlines are kept by InterceptRedact,
+// so the number of lines is unchanged.
+func intercept(b []byte, pos int) []byte {
+	pos = min(max(pos, 0), len(b))
+	switch interceptPolicy {
+	case InterceptRedact:
+		redact(b[pos:])
+		return b
+	case InterceptReplace:
+		// a fresh slice, b may be a sub-slice of a larger buffer, whose
+		// bytes after len(b) must not be overwritten.
+		return append([]byte(nil), interceptPlaceholder...)
+	case InterceptTruncate:
+		return b[:pos]
+	default:
+		return b
+	}
+}
+
+// redact replaces all bytes except newlines with '*'.
+func redact(b []byte) {
+	for i := range b {
+		if b[i] != '\n' && b[i] != '\r' {
+			b[i] = '*'
+		}
+	}
+}
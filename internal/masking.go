@@ -15,46 +15,105 @@
 package internal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"strings"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Masker masks the byte slice in-place.
 type Masker func(b []byte)
 
-// Rule represents a masking rule.
+// Rule represents a masking rule. A merge updates an existing rule with the
+// non-zero fields of the given one and adds its keys, so a field is never
+// reset to zero by a merge, MergeOptions.Replace replaces the rule instead.
 type Rule struct {
+	Name   string // set by MergeRules
 	Desc   string
 	Masker Masker
 	Length int // searching length after key
 	Keys   []string
+	// Priority decides which rule wins when rules claim the same key, or
+	// when keys of different rules match at the same place, the higher
+	// one wins. Rules of the same priority are decided as before. Like the
+	// other fields, a merge only sets it when it's non-zero, resetting it
+	// to 0 takes MergeOptions.Replace.
+	Priority int
+	// CaseSensitive makes the keys match only in their exact case, e.g.
+	// "ID" doesn't match "id". A merge only sets it when it's true,
+	// clearing it takes MergeOptions.Replace. Changing it reconstructs the
+	// trie with the keys normalized again, the keys are stored in their
+	// case as given.
+	CaseSensitive bool
 }
 
-var cfg = struct {
-	Rules map[string]*Rule
-	Trie  *Trie
-}{
-	Rules: make(map[string]*Rule),
+// normalizeKey returns the key as the rule matches it, the keys are in
+// lower case unless the rule is case-sensitive.
+func (r *Rule) normalizeKey(key string) string {
+	if r.CaseSensitive {
+		return key
+	}
+	return lowerKey(key)
+}
+
+// keysOf returns the keys of the rule equal to the key ignoring case, in
+// their case as given.
+func (r *Rule) keysOf(key string) []string {
+	key = lowerKey(key)
+	var keys []string
+	for _, s := range r.Keys {
+		if lowerKey(s) == key {
+			keys = append(keys, s)
+		}
+	}
+	return keys
+}
+
+// cfg is the trie of the current rules, which are its Rules. A published
+// trie is never modified, the writers modify a clone and publish it, so
+// the masking operations always see a consistent trie without a lock.
+var cfg atomic.Pointer[Trie]
+
+// cfgMu serializes the writers of cfg.
+var cfgMu sync.Mutex
+
+func init() {
+	cfg.Store(NewTrie(nil))
 }
 
-// MergeRules merges new rules and reconstructs the trie.
+// MergeRules merges new rules and updates the trie. The trie is
+// constructed at the first time, then only the new keys are inserted.
 func MergeRules(rules map[string]*Rule) error {
+	_, err := MergeRulesReport(rules, MergeOptions{})
+	return err
+}
+
+// MergeRulesReport is like MergeRules, but it also reports the keys added
+// by the merge that are subsumed, conflicting or unreachable. In strict
+// mode, it fails without merging if there is any diagnostic.
+func MergeRulesReport(rules map[string]*Rule, opts MergeOptions) (*MergeReport, error) {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
 
 	// check the keys of new rules
+	old := cfg.Load()
 	for _, r := range rules {
 		for _, key := range r.Keys {
-			for j := 0; j < len(key); j++ {
-				if key[j] != '*' && charTable[key[j]] == -1 {
-					return fmt.Errorf("invalid key '%s'", key)
-				}
+			if _, err := old.chars.parseKey(key); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	ruleNames := OrderedMapKeys(rules)
-	for _, name := range ruleNames {
+	rebuild := false
+	merged := cloneRules(old.Rules)
+	for _, name := range OrderedMapKeys(rules) {
 		r := rules[name]
-		if t, ok := cfg.Rules[name]; ok { // update existing rules
+		if t, ok := merged[name]; ok && !opts.Replace { // update existing rules
 			if r.Masker != nil {
 				t.Masker = r.Masker
 			}
@@ -64,90 +123,412 @@ func MergeRules(rules map[string]*Rule) error {
 			if r.Length > 0 {
 				t.Length = r.Length
 			}
+			if r.Priority != 0 && r.Priority != t.Priority {
+				t.Priority = r.Priority
+				rebuild = true
+			}
+			if r.CaseSensitive && !t.CaseSensitive {
+				t.CaseSensitive = true
+				rebuild = true
+			}
 			if len(r.Keys) > 0 {
 				ks := make(map[string]struct{})
 				for _, s := range t.Keys {
 					ks[s] = struct{}{}
 				}
 				for _, s := range r.Keys {
-					s = strings.ToLower(s)
 					ks[s] = struct{}{}
 				}
 				t.Keys = OrderedMapKeys(ks)
 			}
-		} else { // add new rules
+		} else { // add new rules, or replace existing ones
+			rebuild = rebuild || ok
 			ks := make(map[string]struct{})
 			for _, s := range r.Keys {
-				s = strings.ToLower(s)
 				ks[s] = struct{}{}
 			}
-			cfg.Rules[name] = &Rule{
-				Desc:   r.Desc,
-				Masker: r.Masker,
-				Length: r.Length,
-				Keys:   OrderedMapKeys(ks),
+			merged[name] = &Rule{
+				Name:          name,
+				Desc:          r.Desc,
+				Masker:        r.Masker,
+				Length:        r.Length,
+				Keys:          OrderedMapKeys(ks),
+				Priority:      r.Priority,
+				CaseSensitive: r.CaseSensitive,
 			}
 		}
 	}
 
-	cfg.Trie = ConstructTrie(cfg.Rules)
+	// the winners of the keys in the trie change with the priorities,
+	// and the keys change with the case sensitivity and the replacement.
+	added := newRuleKeys(old.Rules, merged, rules, opts.Replace)
+	var t *Trie
+	if len(old.Rules) == 0 || rebuild {
+		t = constructTrie(merged, old.chars)
+	} else {
+		t = old.clone(merged)
+		for _, k := range added {
+			if err := t.insert(k.key, merged[k.rule]); err != nil {
+				return nil, err
+			}
+		}
+		t.updatePreferred()
+	}
+
+	report := diagnose(t, added)
+	if opts.Strict && !report.Empty() {
+		return report, fmt.Errorf("%w:\n%s", ErrMergeDiagnostics, report)
+	}
+	cfg.Store(t)
+	return report, nil
+}
+
+// RemoveKeys removes the keys from the rule and the trie. A key shared
+// with other rules is handed over to the one taking precedence.
+func RemoveKeys(name string, keys []string) error {
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+
+	old := cfg.Load()
+	if _, ok := old.Rules[name]; !ok {
+		return fmt.Errorf("rule '%s' not found", name)
+	}
+	rules := cloneRules(old.Rules)
+	r := rules[name]
+	removed := make(map[string]struct{})
+	for _, s := range keys {
+		removed[r.normalizeKey(s)] = struct{}{}
+	}
+	r.Keys = slices.DeleteFunc(r.Keys, func(s string) bool {
+		_, ok := removed[r.normalizeKey(s)]
+		return ok
+	})
+	t := old.clone(rules)
+	for _, key := range OrderedMapKeys(removed) {
+		if !t.remove(key, r) {
+			continue
+		}
+		for _, other := range OrderedMapKeys(rules) {
+			x := rules[other]
+			for _, s := range x.keysOf(key) {
+				_ = t.insert(s, x) // the key is in the trie before
+			}
+		}
+	}
+	t.updatePreferred()
+	cfg.Store(t)
 	return nil
 }
 
+// RuleNames returns the sorted names of all rules.
+func RuleNames() []string {
+	return OrderedMapKeys(cfg.Load().Rules)
+}
+
+// MaxWindow returns the maximum number of bytes a match may span, that is,
+// the length of the longest key plus the maximum searching length of rules.
+func MaxWindow() int {
+	t := cfg.Load()
+	n := 0
+	for _, r := range t.Rules {
+		n = max(n, r.Length)
+	}
+	return t.MaxDepth + n
+}
+
 // DumpTrie outputs all keys reverse-parsed from the prefix tree.
 // It returns a sorted list of all keys presented in the trie.
 func DumpTrie() []string {
-	if cfg.Trie == nil {
-		return nil
-	}
-	return cfg.Trie.DumpTrie()
+	return cfg.Load().DumpTrie()
+}
+
+// DumpTrieRules returns the name of the rule that wins each key.
+func DumpTrieRules() map[string]string {
+	return cfg.Load().DumpTrieRules()
+}
+
+// DumpDOT renders the trie in the Graphviz DOT language.
+func DumpDOT(prefix string) string {
+	return cfg.Load().DumpDOT(prefix)
 }
 
 // KeyFilter defines a function type that checks whether a matched key is valid.
 type KeyFilter func(b []byte, start int, end int, anyStart bool, anyEnd bool) bool
 
-var keyFilter = DefaultKeyFilter
+var (
+	keyFilter       = DefaultKeyFilter
+	customKeyFilter bool // whether keyFilter is not DefaultKeyFilter
+)
 
-// SetKeyFilter sets the key filter.
+// SetKeyFilter sets the key filter, nil restores DefaultKeyFilter.
 func SetKeyFilter(f KeyFilter) {
-	keyFilter = f
+	if f == nil {
+		keyFilter, customKeyFilter = DefaultKeyFilter, false
+		return
+	}
+	keyFilter, customKeyFilter = f, true
+}
+
+// SetExtraKeyChars sets the extra characters allowed in keys, and then
+// reconstructs the trie. It fails if any character is not valid, or if a
+// key of the current rules contains a character no longer allowed. The
+// characters and the trie are replaced together, so it's safe to call it
+// while masking.
+func SetExtraKeyChars(chars string) error {
+	for i := 0; i < len(chars); i++ {
+		if !IsExtraKeyChar(chars[i]) {
+			return fmt.Errorf("invalid key char %q", chars[i])
+		}
+	}
+	cfgMu.Lock()
+	defer cfgMu.Unlock()
+
+	t := cfg.Load()
+	k := newKeyChars(chars)
+	for _, name := range OrderedMapKeys(t.Rules) {
+		for _, key := range t.Rules[name].Keys {
+			if _, err := k.parseKey(key); err != nil {
+				return fmt.Errorf("%w of rule '%s'", err, name)
+			}
+		}
+	}
+	cfg.Store(constructTrie(t.Rules, k))
+	return nil
 }
 
 // Mask masks the byte slice in-place. It accepts a maximum tolerable
 // time in microseconds, if the operation cost is over the maximum
 // tolerable time, then the operation is interrupted and returns true.
 func Mask(b []byte, maxTolerable int64) (_ []byte, intercepted bool) {
+	b, reason := MaskBudget(b, NewBudget(context.Background(), maxTolerable))
+	return b, reason != StopNone
+}
 
-	defer func() {
-		if r := recover(); r != nil {
-			intercepted = true
+// MaskContext masks the byte slice in-place. The operation is interrupted
+// when the context is canceled or its deadline is exceeded, and the reason
+// is returned.
+func MaskContext(ctx context.Context, b []byte) ([]byte, StopReason) {
+	return MaskBudget(b, NewContextBudget(ctx))
+}
+
+// MaskLimits masks the byte slice in-place within the context and the
+// limits, and returns the reason why the operation stopped.
+func MaskLimits(ctx context.Context, b []byte, l Limits) ([]byte, StopReason) {
+	return MaskBudget(b, NewLimitsBudget(ctx, l))
+}
+
+// MaskPanic records a panic recovered during a masking operation.
+type MaskPanic struct {
+	Rule  string // name of the rule whose masker panicked, empty if matching panicked
+	Value any    // the value passed to panic
+	Stack []byte // the stack trace of the goroutine that panicked
+}
+
+// MaskResult reports the details of a masking operation.
+type MaskResult struct {
+	Found    int           // number of the matches found
+	Masked   int           // number of the matches masked
+	Duration time.Duration // time spent by the operation
+	Reason   StopReason    // why the operation stopped
+	Panics   []MaskPanic   // panics recovered during the operation
+}
+
+// Unmasked returns the number of the matches left unmasked.
+func (r *MaskResult) Unmasked() int {
+	return r.Found - r.Masked
+}
+
+// MaskEx masks the byte slice in-place within the context and the
+// limits, and returns the details of the operation.
+func MaskEx(ctx context.Context, b []byte, l Limits) ([]byte, MaskResult) {
+	var r MaskResult
+	start := time.Now()
+	b = MaskResultBudget(b, NewLimitsBudget(ctx, l), &r)
+	r.Duration = time.Since(start)
+	return b, r
+}
+
+// MaskBudget masks the byte slice in-place within the given budget.
+// It returns the reason why the operation stopped. If the operation
+// is interrupted, the intercept policy is applied to the unscanned
+// remainder, so the returned slice may differ from the given one.
+func MaskBudget(b []byte, budget *Budget) ([]byte, StopReason) {
+	var r MaskResult
+	b = MaskResultBudget(b, budget, &r)
+	return b, r.Reason
+}
+
+// MaskResultBudget masks the byte slice in-place within the given budget,
+// and records the details of the operation into r.
+func MaskResultBudget(b []byte, budget *Budget, r *MaskResult) []byte {
+	return MaskRangeBudget(b, 0, len(b), budget, r)
+}
+
+// MaskRangeBudget is like MaskResultBudget, but only the matches whose keys
+// start in [from, to) are masked, the bytes out of the range provide the
+// context of the keys and the values. If the operation is interrupted, the
+// intercept policy is applied to the rest of the range. It returns the
+// masked range, which may differ from b[from:to].
+func MaskRangeBudget(b []byte, from, to int, budget *Budget, r *MaskResult) []byte {
+	o := observer
+	if o == nil {
+		pos := mask(b, from, to, budget, r, nil)
+		if r.Reason != StopNone {
+			return intercept(b[from:to], pos-from)
 		}
-	}()
+		return b[from:to]
+	}
+	start := time.Now()
+	pos := mask(b, from, to, budget, r, o)
+	out := b[from:to]
+	if r.Reason != StopNone {
+		out = intercept(out, pos-from)
+		o.OnIntercept(r.Reason)
+	}
+	for _, p := range r.Panics {
+		o.OnPanic(p)
+	}
+	o.OnDuration(time.Since(start))
+	return out
+}
+
+// mask masks the byte slice in-place within the given budget, which spans
+// both the matching and the masking phases, but only the matches whose keys
+// start in [from, to). It returns the position from which the bytes may
+// still contain sensitive data. A panic in a masker only affects its own
+// match, the remaining matches are still masked.
+func mask(b []byte, from, to int, budget *Budget, r *MaskResult, o Observer) int {
 
-	arr, intercepted := cfg.Trie.Match(b, keyFilter, maxTolerable)
-	if len(arr) == 0 {
-		return b, intercepted
+	if r.Reason = budget.Check(); r.Reason != StopNone {
+		return 0
 	}
 
-	l := len(b)
-	for i := len(arr) - 1; i >= 0; i-- {
-		p := arr[i]
-		maxEnd := p.End + p.Rule.Length + 1
-		if maxEnd >= l {
-			maxEnd = l
+	arr, pos, reason, p := match(b, budget)
+	if p != nil {
+		r.Reason = StopPanic
+		r.Panics = append(r.Panics, *p)
+		return 0
+	}
+	r.Reason = reason
+
+	// drops the matches out of the range, which are in order.
+	for len(arr) > 0 && arr[0].Start < from {
+		arr = arr[1:]
+	}
+	for len(arr) > 0 && arr[len(arr)-1].Start >= to {
+		arr = arr[:len(arr)-1]
+	}
+	r.Found = len(arr)
+
+	var scratch []byte
+	if o != nil {
+		for _, m := range arr {
+			o.OnRuleHit(m.Rule.Name)
+		}
+	}
+
+	forEachMaskOrder(arr, func(i int) bool {
+		// exits if the budget is exhausted, the maskers are applied from
+		// the last window, so the unmasked values start from the first one.
+		if reason = budget.Check(); reason != StopNone {
+			r.Reason = reason
+			pos = min(pos, arr[0].WinStart)
+			return false
+		}
+		w := valueWindow(b, arr[i])
+		if o != nil {
+			scratch = append(scratch[:0], w...)
+		}
+		if p = applyMasker(arr[i].Rule, w); p != nil {
+			r.Reason = StopPanic
+			r.Panics = append(r.Panics, *p)
+			pos = min(pos, arr[i].WinStart)
+			return true
+		}
+		r.Masked++
+		if o != nil {
+			o.OnMasked(arr[i].Rule.Name, !bytes.Equal(scratch, w))
+		}
+		return true
+	})
+
+	return pos
+}
+
+// RuleOfKey returns the rule whose key matches the end of the given key,
+// or nil if no rule matches.
+func RuleOfKey(key string) *Rule {
+	b := make([]byte, 0, len(key)+1)
+	b = append(append(b, key...), 0) // the terminator is a splitter
+	var r *Rule
+	_, _ = cfg.Load().MatchFunc(b, keyFilter, NewContextBudget(context.Background()), nil, func(p Position) bool {
+		if p.End == len(key)-1 {
+			r = p.Rule
 		}
-		s := b[p.End+1 : maxEnd]
-		p.Rule.Masker(s)
+		return true
+	})
+	return r
+}
+
+// MaskValue masks the value in-place with the rule whose key matches the end
+// of the given key, as if the value follows the key. It reports whether such
+// a rule exists, and whether the value is changed.
+func MaskValue(key string, value []byte) (matched bool, changed bool) {
+	defer func() {
+		// fails closed, a value that can't be masked is fully redacted.
+		if v := recover(); v != nil {
+			redact(value)
+			matched, changed = true, true
+		}
+	}()
+	r := RuleOfKey(key)
+	if r == nil {
+		return false, false
 	}
+	w := value[:min(r.Length, len(value))]
+	s := append([]byte(nil), w...)
+	if applyMasker(r, w) != nil {
+		redact(value)
+		return true, true
+	}
+	return true, !bytes.Equal(s, w)
+}
+
+// match performs a match operation and recovers the panic if any.
+func match(b []byte, budget *Budget) (arr []Position, pos int, reason StopReason, p *MaskPanic) {
+	defer func() {
+		if v := recover(); v != nil {
+			p = &MaskPanic{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	arr, pos, reason = cfg.Load().Match(b, keyFilter, budget)
+	resolveWindows(arr, len(b))
+	return
+}
 
-	return b, intercepted
+// valueWindow returns the masking window of the match, which is searched
+// by the masker of the matched rule.
+func valueWindow(b []byte, p Position) []byte {
+	return b[p.WinStart:p.WinEnd]
+}
+
+// applyMasker applies the masker of the rule on the bytes, and recovers
+// the panic if any.
+func applyMasker(r *Rule, s []byte) (mp *MaskPanic) {
+	defer func() {
+		if v := recover(); v != nil {
+			mp = &MaskPanic{Rule: r.Name, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	r.Masker(s)
+	return nil
 }
 
 func startSplitter(b []byte, start int, anyStart bool) bool {
 	if start <= 0 { // no other characters on the left
 		return true
 	}
-	if splitterTable[b[start-1]] {
+	if splitterBefore(b, start) {
 		return true
 	}
 	if anyStart { // pattern matching
@@ -163,7 +544,7 @@ func startSplitter(b []byte, start int, anyStart bool) bool {
 }
 
 func endSplitter(t []byte, end int, andEnd bool) bool {
-	if splitterTable[t[end+1]] {
+	if splitterAfter(t, end) {
 		return true
 	}
 	if andEnd { // pattern matching
@@ -0,0 +1,205 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Observer observes the masking operations. Its methods are called
+// synchronously by the masking functions, so they should be fast and
+// safe for concurrent use.
+type Observer interface {
+	// OnRuleHit is called for each match found.
+	OnRuleHit(rule string)
+	// OnMasked is called after the masker of a match is applied, changed
+	// reports whether the masker modified any byte.
+	OnMasked(rule string, changed bool)
+	// OnIntercept is called when a masking operation is interrupted.
+	OnIntercept(reason StopReason)
+	// OnPanic is called for each panic recovered.
+	OnPanic(p MaskPanic)
+	// OnDuration is called with the time spent by each masking operation.
+	OnDuration(d time.Duration)
+}
+
+var observer Observer
+
+// SetObserver sets the observer, nil disables observing.
+func SetObserver(o Observer) {
+	observer = o
+}
+
+// LatencyBounds are the upper bounds of the latency histogram buckets.
+var LatencyBounds = []time.Duration{
+	time.Microsecond,
+	2 * time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	20 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+}
+
+// maxStopReason is the number of stop reasons that can be counted.
+const maxStopReason = 8
+
+// ruleCounters counts the events of a rule.
+type ruleCounters struct {
+	hits      atomic.Int64
+	changed   atomic.Int64
+	unchanged atomic.Int64
+	panics    atomic.Int64
+}
+
+// Counters is an Observer that counts the events with atomic operations.
+type Counters struct {
+	rules       sync.Map // rule name -> *ruleCounters
+	intercepted [maxStopReason]atomic.Int64
+	panics      atomic.Int64
+	buckets     []atomic.Int64 // the last one is +Inf
+	sum         atomic.Int64   // in nanoseconds
+	count       atomic.Int64
+}
+
+// NewCounters returns an empty Counters.
+func NewCounters() *Counters {
+	return &Counters{buckets: make([]atomic.Int64, len(LatencyBounds)+1)}
+}
+
+// rule returns the counters of the rule, creates one if not exists.
+func (c *Counters) rule(name string) *ruleCounters {
+	if v, ok := c.rules.Load(name); ok {
+		return v.(*ruleCounters)
+	}
+	v, _ := c.rules.LoadOrStore(name, &ruleCounters{})
+	return v.(*ruleCounters)
+}
+
+// OnRuleHit implements Observer.
+func (c *Counters) OnRuleHit(rule string) {
+	c.rule(rule).hits.Add(1)
+}
+
+// OnMasked implements Observer.
+func (c *Counters) OnMasked(rule string, changed bool) {
+	if changed {
+		c.rule(rule).changed.Add(1)
+	} else {
+		c.rule(rule).unchanged.Add(1)
+	}
+}
+
+// OnIntercept implements Observer.
+func (c *Counters) OnIntercept(reason StopReason) {
+	if reason >= 0 && reason < maxStopReason {
+		c.intercepted[reason].Add(1)
+	}
+}
+
+// OnPanic implements Observer.
+func (c *Counters) OnPanic(p MaskPanic) {
+	c.panics.Add(1)
+	if p.Rule != "" {
+		c.rule(p.Rule).panics.Add(1)
+	}
+}
+
+// OnDuration implements Observer.
+func (c *Counters) OnDuration(d time.Duration) {
+	i := 0
+	for i < len(LatencyBounds) && d > LatencyBounds[i] {
+		i++
+	}
+	c.buckets[i].Add(1)
+	c.sum.Add(int64(d))
+	c.count.Add(1)
+}
+
+// RuleCounts is the counts of the events of a rule.
+type RuleCounts struct {
+	Hits      int64 // matches found
+	Changed   int64 // maskers applied that modified the bytes
+	Unchanged int64 // maskers applied that modified nothing
+	Panics    int64 // maskers panicked
+}
+
+// Histogram is a snapshot of the latency histogram.
+type Histogram struct {
+	Bounds []time.Duration // upper bounds of the buckets
+	Counts []int64         // counts of the buckets, the last one is +Inf
+	Sum    time.Duration   // sum of all observations
+	Count  int64           // number of all observations
+}
+
+// CountersSnapshot is a snapshot of the Counters.
+type CountersSnapshot struct {
+	Rules       map[string]RuleCounts // counts by rule name
+	Intercepted map[string]int64      // counts by stop reason
+	Panics      int64                 // number of all panics
+	Latency     Histogram             // latency of the masking operations
+}
+
+// Snapshot returns a snapshot of the counters. The counters are read
+// one by one, so the snapshot may be slightly inconsistent under load.
+func (c *Counters) Snapshot() CountersSnapshot {
+	s := CountersSnapshot{
+		Rules:       make(map[string]RuleCounts),
+		Intercepted: make(map[string]int64),
+		Panics:      c.panics.Load(),
+		Latency: Histogram{
+			Bounds: append([]time.Duration(nil), LatencyBounds...),
+			Counts: make([]int64, len(c.buckets)),
+			Sum:    time.Duration(c.sum.Load()),
+			Count:  c.count.Load(),
+		},
+	}
+	c.rules.Range(func(k, v any) bool {
+		r := v.(*ruleCounters)
+		s.Rules[k.(string)] = RuleCounts{
+			Hits:      r.hits.Load(),
+			Changed:   r.changed.Load(),
+			Unchanged: r.unchanged.Load(),
+			Panics:    r.panics.Load(),
+		}
+		return true
+	})
+	for i := range c.intercepted {
+		if n := c.intercepted[i].Load(); n > 0 {
+			s.Intercepted[StopReason(i).String()] = n
+		}
+	}
+	for i := range c.buckets {
+		s.Latency.Counts[i] = c.buckets[i].Load()
+	}
+	return s
+}
+
+// Publish publishes the snapshot of the counters via expvar with the name.
+// Like expvar.Publish, it panics if the name is already registered.
+func (c *Counters) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return c.Snapshot()
+	}))
+}
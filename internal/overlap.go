@@ -0,0 +1,151 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+// OverlapPolicy defines how the masking windows of the close matches are
+// resolved. The window of a match starts right after its key, and spans
+// at most Rule.Length bytes, so it may cover the following keys.
+type OverlapPolicy int
+
+const (
+	OverlapAllow OverlapPolicy = iota // windows may overlap the following keys and windows
+	OverlapClip                       // each window is clipped at the start of the next key
+	OverlapMerge                      // overlapping windows of the same rule are merged, others are clipped
+)
+
+// String returns the name of the overlap policy.
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapAllow:
+		return "allow"
+	case OverlapClip:
+		return "clip"
+	case OverlapMerge:
+		return "merge"
+	default:
+		return "unknown"
+	}
+}
+
+var overlapPolicy = OverlapAllow
+
+// SetOverlapPolicy sets the overlap policy.
+func SetOverlapPolicy(p OverlapPolicy) {
+	overlapPolicy = p
+}
+
+// windowResolver computes the masking windows of the matches as they are
+// found in order, and emits a match once its window is final.
+type windowResolver struct {
+	policy  OverlapPolicy
+	length  int        // length of the input
+	pending []Position // the matches whose windows are not final
+	end     int        // end of the merged window of the pending matches
+	emit    func(Position) bool
+}
+
+// newWindowResolver returns a resolver with the current overlap policy.
+func newWindowResolver(length int, emit func(Position) bool) *windowResolver {
+	return &windowResolver{policy: overlapPolicy, length: length, emit: emit}
+}
+
+// add adds a match, and returns false if emit returns false.
+func (r *windowResolver) add(p Position) bool {
+	p.WinStart = p.End + 1
+	p.WinEnd = min(p.End+1+p.Rule.Length, r.length)
+	switch r.policy {
+	case OverlapClip:
+		if len(r.pending) > 0 {
+			q := r.pending[0]
+			q.WinEnd = max(min(q.WinEnd, p.Start), q.WinStart)
+			r.pending = r.pending[:0]
+			if !r.emit(q) {
+				return false
+			}
+		}
+		r.pending = append(r.pending, p)
+		return true
+	case OverlapMerge:
+		if len(r.pending) > 0 {
+			if p.Rule == r.pending[0].Rule && p.Start < r.end {
+				r.pending = append(r.pending, p)
+				r.end = max(r.end, p.WinEnd)
+				return true
+			}
+			r.end = min(r.end, p.Start)
+			if !r.flush() {
+				return false
+			}
+		}
+		r.pending = append(r.pending, p)
+		r.end = p.WinEnd
+		return true
+	default:
+		return r.emit(p)
+	}
+}
+
+// flush emits the pending matches, and returns false if emit returns false.
+func (r *windowResolver) flush() bool {
+	if len(r.pending) == 0 {
+		return true
+	}
+	start := r.pending[0].WinStart
+	for _, q := range r.pending {
+		if r.policy == OverlapMerge {
+			q.WinStart, q.WinEnd = start, r.end
+		}
+		if !r.emit(q) {
+			return false
+		}
+	}
+	r.pending = r.pending[:0]
+	r.end = 0
+	return true
+}
+
+// forEachMaskOrder calls f with the index of each match in the order the
+// maskers are applied: from the last window to the first one, and from the
+// front to the back among the matches sharing a merged window, so that each
+// masker sees the values masked by the previous ones. It stops when f
+// returns false.
+func forEachMaskOrder(arr []Position, f func(i int) bool) {
+	for end := len(arr); end > 0; {
+		start := end - 1
+		for start > 0 && arr[start-1].WinStart == arr[end-1].WinStart && arr[start-1].WinEnd == arr[end-1].WinEnd {
+			start--
+		}
+		for i := start; i < end; i++ {
+			if !f(i) {
+				return
+			}
+		}
+		end = start
+	}
+}
+
+// resolveWindows computes the masking windows of the matches in-place.
+func resolveWindows(arr []Position, length int) {
+	i := 0
+	r := newWindowResolver(length, func(p Position) bool {
+		arr[i] = p
+		i++
+		return true
+	})
+	for _, p := range arr {
+		r.add(p)
+	}
+	r.flush()
+}
@@ -0,0 +1,254 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MergeOptions configures MergeRulesReport.
+type MergeOptions struct {
+	Strict  bool // fails without merging if there is any diagnostic
+	Replace bool // replaces the existing rules with the given fields and keys, instead of updating them
+}
+
+// SubsumedKey is a key sharing a trie node with a more general variant of
+// no lower priority, e.g. "abc" is subsumed by "*abc*", so it never matches
+// as itself.
+type SubsumedKey struct {
+	Key    string // the subsumed key
+	Rule   string // rule of the subsumed key
+	By     string // the more general key
+	ByRule string // rule of the more general key
+}
+
+// KeyConflict is a key claimed by multiple rules.
+type KeyConflict struct {
+	Key    string   // the key
+	Rules  []string // names of the rules claiming the key, the winner first
+	Winner string   // name of the rule keeping the key
+}
+
+// UnreachableKey is a key that never matches in all the typical contexts,
+// as the key filter rejects it, or other keys take precedence over it.
+type UnreachableKey struct {
+	Key  string
+	Rule string
+}
+
+// MergeReport reports the keys silently subsumed or dropped by a merge.
+// Only the keys added by the merge are diagnosed.
+type MergeReport struct {
+	Subsumed    []SubsumedKey
+	Conflicts   []KeyConflict
+	Unreachable []UnreachableKey
+}
+
+// ErrMergeDiagnostics is returned by MergeRulesReport in strict mode when
+// there is any diagnostic.
+var ErrMergeDiagnostics = errors.New("rules have diagnostics")
+
+// Empty reports whether there is no diagnostic.
+func (r *MergeReport) Empty() bool {
+	return len(r.Subsumed) == 0 && len(r.Conflicts) == 0 && len(r.Unreachable) == 0
+}
+
+// String returns the diagnostics one per line.
+func (r *MergeReport) String() string {
+	var lines []string
+	for _, k := range r.Subsumed {
+		lines = append(lines, fmt.Sprintf("key %q of rule %s is subsumed by %q of rule %s", k.Key, k.Rule, k.By, k.ByRule))
+	}
+	for _, k := range r.Conflicts {
+		lines = append(lines, fmt.Sprintf("key %q is claimed by rules %s, rule %s wins", k.Key, strings.Join(k.Rules, ", "), k.Winner))
+	}
+	for _, k := range r.Unreachable {
+		lines = append(lines, fmt.Sprintf("key %q of rule %s never matches, the key filter rejects it or other keys take precedence", k.Key, k.Rule))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ruleKey is a key claimed by a rule.
+type ruleKey struct {
+	key  string
+	rule string
+}
+
+// newRuleKeys returns the keys that the rules add to the current rules,
+// normalized as the merged rules match them, in the order of the rule
+// names and the keys. All the keys of a replaced rule are added.
+func newRuleKeys(current, merged, rules map[string]*Rule, replace bool) []ruleKey {
+	var added []ruleKey
+	for _, name := range OrderedMapKeys(rules) {
+		r := merged[name]
+		old := make(map[string]struct{})
+		if t, ok := current[name]; ok && !replace {
+			for _, s := range t.Keys {
+				old[r.normalizeKey(s)] = struct{}{}
+			}
+		}
+		ks := make(map[string]struct{})
+		for _, s := range rules[name].Keys {
+			s = r.normalizeKey(s)
+			if _, found := old[s]; !found {
+				ks[s] = struct{}{}
+			}
+		}
+		for _, s := range OrderedMapKeys(ks) {
+			added = append(added, ruleKey{s, name})
+		}
+	}
+	return added
+}
+
+// ownerKey is a key as the rules claim it, the keys of the case-sensitive
+// rules are claimed in their exact case, apart from the others.
+type ownerKey struct {
+	key           string
+	caseSensitive bool
+}
+
+// diagnose reports the diagnostics of the keys added by a merge, next is
+// the trie after the merge.
+func diagnose(next *Trie, added []ruleKey) *MergeReport {
+
+	addedKeys := make(map[ownerKey]struct{})
+	for _, k := range added {
+		addedKeys[ownerKey{k.key, next.Rules[k.rule].CaseSensitive}] = struct{}{}
+	}
+
+	// the rules claiming each added key after the merge, by name.
+	ruleOwners := make(map[ownerKey][]string)
+	for _, name := range OrderedMapKeys(next.Rules) {
+		r := next.Rules[name]
+		for _, s := range r.Keys {
+			key := ownerKey{r.normalizeKey(s), r.CaseSensitive}
+			if _, ok := addedKeys[key]; !ok {
+				continue
+			}
+			if rs := ruleOwners[key]; len(rs) == 0 || rs[len(rs)-1] != name {
+				ruleOwners[key] = append(rs, name)
+			}
+		}
+	}
+
+	// owners returns the rules claiming the key, the winner first.
+	owners := func(key ownerKey) []*Rule {
+		var result []*Rule
+		for _, name := range ruleOwners[key] {
+			result = append(result, next.Rules[name])
+		}
+		sort.SliceStable(result, func(i, j int) bool {
+			return precedes(result[i], result[j])
+		})
+		return result
+	}
+
+	report := &MergeReport{}
+	bareKeys := make(map[string]struct{})
+	for _, key := range orderedOwnerKeys(addedKeys) {
+		p, _ := next.chars.parseKey(key.key) // the keys are checked by MergeRules
+		bareKeys[p.key] = struct{}{}
+
+		if rs := owners(key); len(rs) > 1 {
+			c := KeyConflict{Key: key.key, Winner: rs[0].Name}
+			for _, r := range rs {
+				c.Rules = append(c.Rules, r.Name)
+			}
+			report.Conflicts = append(report.Conflicts, c)
+		}
+	}
+
+	for _, bare := range OrderedMapKeys(bareKeys) {
+		n := next.node(bare)
+		if n == nil || n.variants == nil {
+			continue
+		}
+		for v := range n.variants {
+			r := n.variants[v].top()
+			if r == nil {
+				continue
+			}
+			for _, w := range variantOrder {
+				by := n.variants[w].top()
+				if w == v || w&v != v || by == nil || by.Priority < r.Priority {
+					continue
+				}
+				report.Subsumed = append(report.Subsumed, SubsumedKey{
+					Key:    ParsedKey{bare, v&variantAnyStart != 0, v&variantAnyEnd != 0}.Key(),
+					Rule:   r.Name,
+					By:     ParsedKey{bare, w&variantAnyStart != 0, w&variantAnyEnd != 0}.Key(),
+					ByRule: by.Name,
+				})
+				break
+			}
+		}
+	}
+
+	for _, k := range added {
+		if !reachable(next, k.key) {
+			report.Unreachable = append(report.Unreachable, UnreachableKey{k.key, k.rule})
+		}
+	}
+	return report
+}
+
+// orderedOwnerKeys returns the keys of the map sorted by the key, then the
+// case-insensitive one first.
+func orderedOwnerKeys(m map[ownerKey]struct{}) []ownerKey {
+	keys := make([]ownerKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key < keys[j].key
+		}
+		return !keys[i].caseSensitive && keys[j].caseSensitive
+	})
+	return keys
+}
+
+// probeContexts are the typical contexts of keys, in which a key is probed.
+var probeContexts = [][2]string{
+	{"", ":"}, {"", "="}, {" ", ":"}, {" ", "="},
+	{`"`, `":`}, {`'`, `':`}, {"{", ":"}, {",", ":"},
+	{"&", "="}, {"?", "="}, {"%22", "%22"}, {"<", ">"},
+}
+
+// reachable reports whether the key of the trie matches in any of the
+// typical contexts with the current key filter. The key is probed with the
+// other keys of the trie, so a key shadowed by them never matches either.
+func reachable(t *Trie, key string) bool {
+	p, err := t.chars.parseKey(key)
+	if err != nil {
+		return false
+	}
+	budget := NewContextBudget(context.Background())
+	for _, c := range probeContexts {
+		b := []byte(c[0] + p.exact(key) + c[1])
+		arr, _, _ := t.Match(b, keyFilter, budget)
+		for _, pos := range arr {
+			if pos.Start == len(c[0]) && pos.End == len(c[0])+len(p.key)-1 {
+				return true
+			}
+		}
+	}
+	return false
+}
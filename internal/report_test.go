@@ -0,0 +1,112 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestMergeRulesReport(t *testing.T) {
+	defer cfg.Store(NewTrie(nil))
+	defer SetKeyFilter(nil)
+
+	report, err := MergeRulesReport(map[string]*Rule{
+		"a": {Keys: []string{"abc", "*ABC*", "x_key"}},
+		"b": {Keys: []string{"x_key", "*ab"}},
+	}, MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := &MergeReport{
+		Subsumed:  []SubsumedKey{{Key: "abc", Rule: "a", By: "*abc*", ByRule: "a"}},
+		Conflicts: []KeyConflict{{Key: "x_key", Rules: []string{"a", "b"}, Winner: "a"}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %+v, expect %+v", report, want)
+	}
+	wantStr := `key "abc" of rule a is subsumed by "*abc*" of rule a
+key "x_key" is claimed by rules a, b, rule a wins`
+	if report.String() != wantStr {
+		t.Fatalf("got %s, expect %s", report.String(), wantStr)
+	}
+
+	// only the keys added by the merge are diagnosed.
+	report, err = MergeRulesReport(map[string]*Rule{
+		"b": {Keys: []string{"x_key", "*x_key", "ab*"}},
+	}, MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = &MergeReport{
+		Subsumed: []SubsumedKey{{Key: "x_key", Rule: "a", By: "*x_key", ByRule: "b"}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %+v, expect %+v", report, want)
+	}
+
+	// a key rejected by the key filter in all contexts never matches.
+	SetKeyFilter(func(b []byte, start int, end int, anyStart bool, anyEnd bool) bool {
+		return b[end] != 'x' && DefaultKeyFilter(b, start, end, anyStart, anyEnd)
+	})
+	keys := DumpTrie()
+	report, err = MergeRulesReport(map[string]*Rule{
+		"c": {Keys: []string{"key_x", "key_y", "abc"}},
+	}, MergeOptions{Strict: true})
+	if !errors.Is(err, ErrMergeDiagnostics) {
+		t.Fatalf("got error %v, expect %v", err, ErrMergeDiagnostics)
+	}
+	want = &MergeReport{
+		Subsumed:    []SubsumedKey{{Key: "abc", Rule: "a", By: "*abc*", ByRule: "a"}},
+		Conflicts:   []KeyConflict{{Key: "abc", Rules: []string{"a", "c"}, Winner: "a"}},
+		Unreachable: []UnreachableKey{{Key: "key_x", Rule: "c"}},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %+v, expect %+v", report, want)
+	}
+	if _, ok := cfg.Load().Rules["c"]; ok || !slices.Equal(DumpTrie(), keys) {
+		t.Fatal("expect the rules unchanged in strict mode")
+	}
+
+	// a key shadowed by a key of higher priority never matches.
+	SetKeyFilter(nil)
+	report, err = MergeRulesReport(map[string]*Rule{
+		"d": {Keys: []string{"zq"}},
+		"e": {Keys: []string{"*q"}, Priority: 1},
+	}, MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = &MergeReport{Unreachable: []UnreachableKey{{Key: "zq", Rule: "d"}}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("got %+v, expect %+v", report, want)
+	}
+
+	// a replaced rule keeps only the given fields and keys.
+	report, err = MergeRulesReport(map[string]*Rule{
+		"e": {Keys: []string{"yq"}},
+	}, MergeOptions{Replace: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r := cfg.Load().Rules["e"]; r.Priority != 0 || !slices.Equal(r.Keys, []string{"yq"}) {
+		t.Fatalf("got %+v, expect the rule replaced", r)
+	}
+	if trie := cfg.Load(); !report.Empty() || trie.Lookup("*q") != nil || trie.Lookup("zq") == nil {
+		t.Fatalf("got %s, expect *q removed and zq reachable", report)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"slices"
+)
+
+// Finding describes a piece of sensitive data found by Scan. The spans
+// are half-open, that is, the key is b[KeyStart:KeyEnd].
+type Finding struct {
+	KeyStart   int    // start of the matched key
+	KeyEnd     int    // end of the matched key
+	ValueStart int    // start of the bytes the masker would change
+	ValueEnd   int    // end of the bytes the masker would change, equal to ValueStart if nothing
+	Rule       string // name of the matched rule
+	Desc       string // description of the matched rule
+}
+
+// Scan finds the sensitive data in the byte slice without modifying it.
+func Scan(b []byte) []Finding {
+	var result []Finding
+	ScanFunc(b, func(f Finding) bool {
+		result = append(result, f)
+		return true
+	})
+	return result
+}
+
+// ScanFunc is like Scan, but it calls yield for each finding in order,
+// and stops when yield returns false. The findings are yielded once a key
+// is matched after their windows, which can't be changed by the following
+// matches then, so the input is neither copied nor matched as a whole
+// first. It returns StopPanic if the matching or a
+// masker panicked, the findings before a panic of the matching are still
+// yielded, and the whole window of a panicking masker is reported as its
+// value span, since Mask redacts it.
+func ScanFunc(b []byte, yield func(Finding) bool) (reason StopReason) {
+	s := &scanner{b: b, yield: yield}
+	defer func() {
+		if !s.yielding && recover() != nil { // a panic of yield is not ours.
+			reason = StopPanic
+		}
+	}()
+	r := newWindowResolver(len(b), s.add)
+	budget := NewContextBudget(context.Background())
+	if _, reason = cfg.Load().MatchFunc(b, keyFilter, budget, nil, r.add); reason != StopNone || s.stopped {
+		return reason
+	}
+	if r.flush() {
+		s.report()
+	}
+	return s.reason
+}
+
+// scanner groups the matches of ScanFunc whose windows may affect each
+// other, and reports the findings of a group once it's complete.
+type scanner struct {
+	b        []byte
+	yield    func(Finding) bool
+	group    []Position // the matches of the group, in order
+	end      int        // end of the windows of the group
+	spans    [][2]int   // the value spans of the group, relative to the windows
+	c        []byte     // copy of the windows of the group
+	scratch  []byte
+	yielding bool // whether calling yield
+	stopped  bool // whether yield returned false
+	reason   StopReason
+}
+
+// add adds a match whose window is final. The group is complete when the
+// key of the match starts after its windows, since the windows of the
+// following matches start after their keys.
+func (s *scanner) add(p Position) bool {
+	if len(s.group) > 0 && p.Start >= s.end {
+		if !s.report() {
+			return false
+		}
+	}
+	if len(s.group) == 0 {
+		s.end = 0
+	}
+	s.end = max(s.end, p.WinEnd)
+	s.group = append(s.group, p)
+	return true
+}
+
+// report applies the maskers of the group on a copy of its windows in the
+// same order as mask, so that each finding reports what its masker changes
+// after the previous ones, then yields the findings of the group. It
+// returns false if yield returns false.
+func (s *scanner) report() bool {
+	if len(s.group) == 0 {
+		return true
+	}
+	start := s.group[0].WinStart
+	s.c = append(s.c[:0], s.b[start:s.end]...)
+	s.spans = slices.Grow(s.spans[:0], len(s.group))[:len(s.group)]
+	forEachMaskOrder(s.group, func(i int) bool {
+		p := s.group[i]
+		w := s.c[p.WinStart-start : p.WinEnd-start]
+		s.scratch = append(s.scratch[:0], w...)
+		if applyMasker(p.Rule, w) != nil {
+			s.reason = StopPanic
+			s.spans[i] = [2]int{0, len(w)}
+			return true
+		}
+		a, z := diffSpan(s.scratch, w)
+		s.spans[i] = [2]int{a, z}
+		return true
+	})
+
+	s.yielding = true
+	for i, p := range s.group {
+		f := Finding{
+			KeyStart:   p.Start,
+			KeyEnd:     p.End + 1,
+			ValueStart: p.WinStart + s.spans[i][0],
+			ValueEnd:   p.WinStart + s.spans[i][1],
+			Rule:       p.Rule.Name,
+			Desc:       p.Rule.Desc,
+		}
+		if !s.yield(f) {
+			s.stopped = true
+			break
+		}
+	}
+	s.yielding = false
+	s.group = s.group[:0]
+	return !s.stopped
+}
+
+// diffSpan returns the span of the bytes that differ between a and b,
+// which have the same length.
+func diffSpan(a, b []byte) (start, end int) {
+	if bytes.Equal(a, b) {
+		return 0, 0
+	}
+	for start < len(a) && a[start] == b[start] {
+		start++
+	}
+	end = len(a)
+	for end > start && a[end-1] == b[end-1] {
+		end--
+	}
+	return start, end
+}
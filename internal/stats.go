@@ -0,0 +1,94 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"unsafe"
+)
+
+// SectionStats describes the children in a section of TrieNode.Child.
+type SectionStats struct {
+	Children    int // number of the children in the section of all nodes
+	MaxChildren int // maximum number of the children in the section of a node
+}
+
+// TrieStats describes the shape and the memory footprint of a trie.
+type TrieStats struct {
+	Nodes         int                        // number of nodes, including the root
+	Keys          int                        // number of keys, the wildcard variants are counted separately
+	TerminalNodes int                        // number of terminal nodes
+	MaxDepth      int                        // depth of the deepest node, that is, the longest key
+	AvgDepth      float64                    // average depth of the terminal nodes, that is, the average key length
+	Sections      [SectionCount]SectionStats // distribution of the children by section, both cases of a letter are counted
+	Bytes         int                        // estimated memory footprint in bytes
+	WildcardNodes int                        // number of terminal nodes with a start or an end wildcard
+	CollapsedKeys int                        // number of keys sharing a terminal node with another variant, e.g. "abc" and "*abc*"
+}
+
+// Stats returns the statistics of the trie.
+func (t *Trie) Stats() TrieStats {
+	s := TrieStats{
+		Nodes:    len(t.Nodes),
+		MaxDepth: t.MaxDepth,
+		Bytes:    int(unsafe.Sizeof(Trie{})) + cap(t.Nodes)*int(unsafe.Sizeof(&TrieNode{})),
+	}
+	depths := 0
+	for _, n := range t.Nodes {
+		s.Bytes += int(unsafe.Sizeof(TrieNode{}))
+		for i, child := range n.Child {
+			s.Sections[i].Children += len(child)
+			s.Sections[i].MaxChildren = max(s.Sections[i].MaxChildren, len(child))
+			s.Bytes += cap(child) * int(unsafe.Sizeof(CharState{}))
+		}
+		if n.variants != nil {
+			s.Bytes += int(unsafe.Sizeof(*n.variants))
+			for _, vk := range n.variants {
+				s.Bytes += cap(vk.exact) * int(unsafe.Sizeof(exactKey{}))
+				for _, e := range vk.exact {
+					s.Bytes += len(e.key)
+				}
+			}
+		}
+		if !n.End {
+			continue
+		}
+		s.TerminalNodes++
+		depths += n.Depth
+		if n.AnyStart || n.AnyEnd {
+			s.WildcardNodes++
+		}
+		keys := 1
+		if n.variants != nil {
+			keys = 0
+			for _, vk := range n.variants {
+				if vk.rule != nil {
+					keys++
+				}
+				keys += len(vk.exact)
+			}
+		}
+		s.Keys += keys
+		s.CollapsedKeys += keys - 1
+	}
+	if s.TerminalNodes > 0 {
+		s.AvgDepth = float64(depths) / float64(s.TerminalNodes)
+	}
+	return s
+}
+
+// Stats returns the statistics of the trie.
+func Stats() TrieStats {
+	return cfg.Load().Stats()
+}
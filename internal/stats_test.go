@@ -0,0 +1,58 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestTrieStats(t *testing.T) {
+	trie := ConstructTrie(map[string]*Rule{
+		"phone": {Name: "phone", Keys: []string{"cell", "*cell*", "cell_*", "*_no"}},
+		"id":    {Name: "id", Keys: []string{"id"}},
+	})
+	got := trie.Stats()
+	if got.Bytes <= 0 {
+		t.Fatalf("got %d bytes, expect positive", got.Bytes)
+	}
+	got.Bytes = 0
+
+	want := TrieStats{
+		Nodes:         11,
+		Keys:          5,
+		TerminalNodes: 4,
+		MaxDepth:      5,
+		AvgDepth:      3.5,
+		Sections: [SectionCount]SectionStats{
+			{Children: 2, MaxChildren: 2}, // o
+			{Children: 2, MaxChildren: 2}, // i
+			{Children: 4, MaxChildren: 3}, // c, _
+			{Children: 2, MaxChildren: 2}, // d
+			{Children: 6, MaxChildren: 2}, // e, l
+			{},
+			{Children: 2, MaxChildren: 2}, // n
+		},
+		WildcardNodes: 3,
+		CollapsedKeys: 1,
+	}
+	if got != want {
+		t.Fatalf("got %+v, expect %+v", got, want)
+	}
+
+	empty := NewTrie(nil).Stats()
+	if empty.Nodes != 1 || empty.Keys != 0 || empty.AvgDepth != 0 {
+		t.Fatalf("unexpected stats %+v", empty)
+	}
+}
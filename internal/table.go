@@ -14,14 +14,29 @@
 
 package internal
 
-// charTable maps valid ASCII characters to bitmap indexes,
-// to quickly determine whether a character is in the trie.
-// a~z, A~Z: 0~25
-// 0~9: 26~35
-// -: 36
-// _: 37
-// @: 38
-var charTable [128]int8
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// keyChars are the characters allowed in keys. A trie holds its keyChars,
+// which never change after the trie is constructed.
+type keyChars struct {
+	// table maps valid characters to bitmap indexes,
+	// to quickly determine whether a character is in the trie.
+	// a~z, A~Z: 0~25
+	// 0~9: 26~35
+	// -: 36
+	// _: 37
+	// @: 38
+	// non-ASCII bytes 0x80~0xFF: 39~166, the bytes of UTF-8 keys
+	// extra key characters: 167~, in the order of the characters
+	table [256]int16
+	extra string // the extra ASCII characters allowed in keys, sorted.
+}
+
+// defaultKeyChars are the characters allowed in keys without any extra.
+var defaultKeyChars = newKeyChars("")
 
 // splitterTable maps valid ASCII characters to whether they
 // are splitter characters. All characters are true except:
@@ -29,34 +44,81 @@ var charTable [128]int8
 // 0~9: false
 // -: false
 // _: false
+// The extra key characters are still splitters. The non-ASCII
+// bytes are splitters too, except next to a non-ASCII key, see
+// splitterBefore and splitterAfter.
 var splitterTable [256]bool
 
 func init() {
-	initCharTable()
 	initSplitterTable()
 }
 
-// initCharTable inits the character mapping table.
-func initCharTable() {
-	for i := 0; i < len(charTable); i++ {
-		charTable[i] = -1
+// IsKeyChar reports whether the character may appear in a key of the
+// current trie.
+func IsKeyChar(c uint8) bool {
+	return cfg.Load().chars.isKeyChar(c)
+}
+
+// isKeyChar reports whether the character may appear in a key.
+func (k *keyChars) isKeyChar(c uint8) bool {
+	return k.table[c] >= 0
+}
+
+// newKeyChars returns the characters allowed in keys with the extra
+// characters, which are sorted and deduplicated. The characters already
+// allowed in keys and the invalid ones are ignored.
+func newKeyChars(extra string) *keyChars {
+	var set [128]bool
+	for i := 0; i < len(extra); i++ {
+		if c := extra[i]; IsExtraKeyChar(c) && c != '-' && c != '_' && c != '@' {
+			set[c] = true
+		}
+	}
+	k := &keyChars{}
+	for c, ok := range set {
+		if ok {
+			k.extra += string(rune(c))
+		}
 	}
-	index := int8(0)
+
+	for i := 0; i < len(k.table); i++ {
+		k.table[i] = -1
+	}
+	index := int16(0)
 	for i := 'a'; i <= 'z'; i++ { // a~z, A~Z: 0~25
-		charTable[i-'a'+'A'] = index
-		charTable[i] = index
+		k.table[i-'a'+'A'] = index
+		k.table[i] = index
 		index++
 	}
 	for i := 0; i <= 9; i++ { // 0~9: 26~35
-		charTable[i+'0'] = index
+		k.table[i+'0'] = index
 		index++
 	}
-	charTable['-'] = index
+	k.table['-'] = index
 	index++
-	charTable['_'] = index
+	k.table['_'] = index
 	index++
-	charTable['@'] = index
+	k.table['@'] = index
 	index++
+	for i := utf8.RuneSelf; i < len(k.table); i++ {
+		k.table[i] = index
+		index++
+	}
+	for i := 0; i < len(k.extra); i++ {
+		k.table[k.extra[i]] = index
+		index++
+	}
+	return k
+}
+
+// IsExtraKeyChar reports whether the character may be set as an extra key
+// character, that is, an ASCII punctuation character other than '*'.
+func IsExtraKeyChar(c uint8) bool {
+	return c > ' ' && c < 0x7f && c != '*' && !isAlphaNum(c)
+}
+
+func isAlphaNum(c uint8) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
 }
 
 // initSplitterTable inits the splitter table.
@@ -74,3 +136,43 @@ func initSplitterTable() {
 	splitterTable['-'] = false
 	splitterTable['_'] = false
 }
+
+// isWordRune reports whether the non-ASCII character may appear in a key,
+// that is, a letter, a digit or a combining mark.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+// splitterBefore reports whether the character before b[i] is a splitter.
+// Between two non-ASCII characters, the splitters are the characters that
+// are not word characters, e.g. full-width punctuation like '：' and '，',
+// so "手机号" doesn't match in "用户手机号".
+func splitterBefore(b []byte, i int) bool {
+	if b[i-1] < utf8.RuneSelf || b[i] < utf8.RuneSelf {
+		return splitterTable[b[i-1]]
+	}
+	r, _ := utf8.DecodeLastRune(b[:i])
+	return !isWordRune(r)
+}
+
+// splitterAfter reports whether the character after b[i] is a splitter,
+// like splitterBefore.
+func splitterAfter(b []byte, i int) bool {
+	if b[i+1] < utf8.RuneSelf || b[i] < utf8.RuneSelf {
+		return splitterTable[b[i+1]]
+	}
+	r, _ := utf8.DecodeRune(b[i+1:])
+	return !isWordRune(r)
+}
+
+// lowerKey lower-cases the ASCII letters of the key, the other characters
+// are matched as they are.
+func lowerKey(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
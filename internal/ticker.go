@@ -15,29 +15,72 @@
 package internal
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-// now is the cached timestamp with microsecond precision.
-var now int64
-
-func init() {
-	start := make(chan struct{})
-	go func() {
-		atomic.StoreInt64(&now, UnixMicro(time.Now()))
-		start <- struct{}{}
-		// update the timestamp every one millisecond.
-		for t := range time.Tick(time.Millisecond) {
-			atomic.StoreInt64(&now, UnixMicro(t))
-		}
-	}()
-	<-start
+// CoarseClock is a clock that caches the current timestamp and updates
+// it periodically in a background goroutine. The goroutine is started
+// lazily on the first use, and it can be stopped by Stop.
+type CoarseClock struct {
+	mutex    sync.Mutex
+	now      atomic.Int64
+	running  atomic.Bool
+	stop     chan struct{}
+	interval time.Duration
+}
+
+// NewCoarseClock returns a clock that updates its cached timestamp
+// every interval.
+func NewCoarseClock(interval time.Duration) *CoarseClock {
+	return &CoarseClock{interval: interval}
 }
 
 // MicroNow returns the cached current Unix timestamp in microseconds.
-func MicroNow() int64 {
-	return atomic.LoadInt64(&now)
+func (c *CoarseClock) MicroNow() int64 {
+	if !c.running.Load() {
+		c.start()
+	}
+	return c.now.Load()
+}
+
+// start starts the background goroutine if it is not running.
+func (c *CoarseClock) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.running.Load() {
+		return
+	}
+	c.now.Store(UnixMicro(time.Now()))
+	c.stop = make(chan struct{})
+	c.running.Store(true)
+	go c.tick(time.NewTicker(c.interval), c.stop)
+}
+
+// tick updates the cached timestamp until the clock is stopped.
+func (c *CoarseClock) tick(ticker *time.Ticker, stop chan struct{}) {
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			c.now.Store(UnixMicro(t))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop stops the background goroutine. The clock is started again
+// when it is used next time.
+func (c *CoarseClock) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.running.Load() {
+		return
+	}
+	close(c.stop)
+	c.running.Store(false)
 }
 
 // UnixMicro converts the given Time to Unix timestamp in microseconds.
@@ -15,8 +15,12 @@
 package internal
 
 import (
+	"bytes"
+	"fmt"
+	"slices"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 const SectionCount = 7
@@ -29,39 +33,110 @@ type CharState struct {
 type TrieNode struct {
 	State       int
 	Child       [SectionCount][]CharState
-	ChildBitMap int64
+	ChildBitMap [4]uint64 // bit i is set if a child char has the index i in the char table
 	Depth       int
 	Rule        *Rule
-	End         bool      // whether it's a terminal node
-	AnyStart    bool      // whether it's start wildcard
-	AnyEnd      bool      // whether it's end wildcard
-	LastEnd     *TrieNode // pointers to the last terminal node
+	End         bool            // whether it's a terminal node
+	AnyStart    bool            // whether a variant has a start wildcard
+	AnyEnd      bool            // whether a variant has an end wildcard
+	LastEnd     *TrieNode       // pointers to the last terminal node
+	variants    *[4]variantKeys // owners of the keys ending here, indexed by their wildcards
+	exact       bool            // whether a variant has keys of case-sensitive rules
+	preferred   []preferredKey  // keys that may take precedence by priority, see preferredMatch
+}
+
+// variantKeys are the owners of a key variant at a node. A key in the exact
+// case of a case-sensitive rule belongs to that rule, and the key in other
+// cases belongs to the case-insensitive rule, so the rules differing only by
+// case keep their own keys.
+type variantKeys struct {
+	rule  *Rule      // the case-insensitive rule of the key, nil if none
+	exact []exactKey // the keys of the case-sensitive rules in their exact case
+}
+
+// exactKey is a key of a case-sensitive rule in its exact case.
+type exactKey struct {
+	key  string
+	rule *Rule
+}
+
+// empty reports whether the variant has no owner.
+func (vk *variantKeys) empty() bool {
+	return vk.rule == nil && len(vk.exact) == 0
+}
+
+// top returns the owner of the variant taking precedence, see precedes.
+func (vk *variantKeys) top() *Rule {
+	rule := vk.rule
+	for _, e := range vk.exact {
+		if rule == nil || precedes(e.rule, rule) {
+			rule = e.rule
+		}
+	}
+	return rule
+}
+
+// ruleFor returns the owner of the variant matching the key, the rule of
+// the key in its exact case first, then the case-insensitive rule.
+func (vk *variantKeys) ruleFor(key []byte) *Rule {
+	for _, e := range vk.exact {
+		if string(key) == e.key { // no allocation in the comparison
+			return e.rule
+		}
+	}
+	return vk.rule
+}
+
+// indexExact returns the index of the exact key, or -1 if not found.
+func (vk *variantKeys) indexExact(key string) int {
+	return slices.IndexFunc(vk.exact, func(e exactKey) bool { return e.key == key })
+}
+
+// preferredKey is a key matching the walked span of a node, which may take
+// precedence over the match at the node by a higher priority.
+type preferredKey struct {
+	node   *TrieNode // terminal node of the key
+	offset int       // offset of the key in the walked span
+	need   int       // wildcards of the variants matching the span there
 }
 
 // Trie represents a trie.
 type Trie struct {
-	Nodes []*TrieNode // all nodes.
-	Trie  *TrieNode   // root node.
+	Nodes    []*TrieNode      // all nodes.
+	Trie     *TrieNode        // root node.
+	MaxDepth int              // depth of the deepest node, that is, the longest key.
+	Rules    map[string]*Rule // rules the trie is constructed from, by name.
+	depths   []int            // number of nodes at each depth.
+
+	chars       *keyChars // characters allowed in the keys.
+	maxPriority int       // upper bound of the priorities of the rules.
+
+	stale    []staleNode // nodes changed since the last updatePreferred.
+	allStale bool        // whether the preferred keys of all nodes are stale.
+}
+
+// staleNode is a node changed by insert or remove, whose change makes the
+// preferred keys of some nodes stale, see updatePreferred.
+type staleNode struct {
+	node     *TrieNode
+	path     string // the key of the node without wildcards
+	ranked   bool   // whether the key of the node had or has a priority
+	anyStart bool   // whether the ranked key had or has a start wildcard
 }
 
 // setNextNode sets the next TrieNode in the trie for a given char.
-func setNextNode(p *TrieNode, c uint8, n *TrieNode) {
+func (t *Trie) setNextNode(p *TrieNode, c uint8, n *TrieNode) {
 	const off = 'a' - 'A'
-	section := charTable[c] % SectionCount
+	if !t.chars.isKeyChar(c) || c >= 'A' && c <= 'Z' {
+		return // never reach, filters unsupported ASCII characters.
+	}
+	m := t.chars.table[c]
+	section := m % SectionCount
 
-	switch {
-	case c >= 'a' && c <= 'z':
-		p.ChildBitMap |= 1 << charTable[c]
-		p.Child[section] = append(p.Child[section], CharState{c, n})
+	p.ChildBitMap[m>>6] |= 1 << (m & 63)
+	p.Child[section] = append(p.Child[section], CharState{c, n})
+	if c >= 'a' && c <= 'z' {
 		p.Child[section] = append(p.Child[section], CharState{c - off, n})
-	case c >= '0' && c <= '9':
-		p.ChildBitMap |= 1 << charTable[c]
-		p.Child[section] = append(p.Child[section], CharState{c, n})
-	case c == '-' || c == '_' || c == '@':
-		p.ChildBitMap |= 1 << charTable[c]
-		p.Child[section] = append(p.Child[section], CharState{c, n})
-	default:
-		return // never reach, filters unsupported ASCII characters.
 	}
 
 	sort.Slice(p.Child[section], func(i, j int) bool {
@@ -69,19 +144,29 @@ func setNextNode(p *TrieNode, c uint8, n *TrieNode) {
 	})
 }
 
-// getNextNode retrieves the next TrieNode based on the given char.
-// It filters out non-ASCII characters and invalid ASCII characters.
-func getNextNode(n *TrieNode, c uint8) *TrieNode {
-	// filters non-ASCII characters, such as Chinese characters
-	if c >= uint8(len(charTable)) {
-		return nil
+// removeNextNode removes the next TrieNode for a given char.
+func (t *Trie) removeNextNode(p *TrieNode, c uint8) {
+	m := t.chars.table[c]
+	section := m % SectionCount
+	child := p.Child[section][:0]
+	for _, x := range p.Child[section] {
+		if t.chars.table[x.Char] != m {
+			child = append(child, x)
+		}
 	}
-	m := charTable[c]
+	p.Child[section] = child
+	p.ChildBitMap[m>>6] &^= 1 << (m & 63)
+}
+
+// getNextNode retrieves the next TrieNode based on the given char.
+// It filters out invalid ASCII characters.
+func (t *Trie) getNextNode(n *TrieNode, c uint8) *TrieNode {
+	m := t.chars.table[c]
 	if m < 0 { // filters invalid ASCII characters
 		return nil
 	}
 	// filters characters not in the trie
-	if n.ChildBitMap&(1<<m) == 0 {
+	if n.ChildBitMap[m>>6]&(1<<(m&63)) == 0 {
 		return nil
 	}
 	child := n.Child[m%SectionCount]
@@ -144,153 +229,588 @@ func (t ParsedKey) Key() string {
 	return s
 }
 
-// sortRuleKeys sorts keys according to their length and character values.
-func sortRuleKeys(size int, iter func() (string, bool)) []ParsedKey {
-	p := make([]ParsedKey, 0, size)
-	for {
-		k, ok := iter()
-		if !ok {
-			break
-		}
+// variants of a key by its wildcards, the bits are combined in "*abc*".
+const (
+	variantExact    = 0 // "abc"
+	variantAnyStart = 1 // "*abc"
+	variantAnyEnd   = 2 // "abc*"
+	variantAnyBoth  = 3 // "*abc*"
+)
 
-		anyEnd := false
-		anyStart := false
-		{
-			if k[0] == '*' {
-				anyStart = true
-				k = k[1:]
-			}
-			n := len(k)
-			if k[n-1] == '*' {
-				anyEnd = true
-				k = k[:n-1]
-			}
-		}
+// exact returns the key without wildcards in its exact case, k is the key
+// the ParsedKey is parsed from.
+func (t ParsedKey) exact(k string) string {
+	if t.anyStart {
+		k = k[1:]
+	}
+	return k[:len(t.key)]
+}
 
-		found := false
-		for i, m := range p {
-			if m.key != k {
-				continue
-			}
-			found = true
-			if !m.anyStart && anyStart {
-				p[i].anyStart = anyStart
-			}
-			if !m.anyEnd && anyEnd {
-				p[i].anyEnd = anyEnd
-			}
-			break
-		}
-		if found {
-			continue
+// variant returns the variant index of the key.
+func (t ParsedKey) variant() int {
+	v := variantExact
+	if t.anyStart {
+		v |= variantAnyStart
+	}
+	if t.anyEnd {
+		v |= variantAnyEnd
+	}
+	return v
+}
+
+// parseKey lower-cases the key and strips its wildcards. A key may contain
+// non-ASCII letters and digits in UTF-8, e.g. "手机号".
+func (c *keyChars) parseKey(k string) (ParsedKey, error) {
+	p := ParsedKey{key: lowerKey(k)}
+	if strings.HasPrefix(p.key, "*") {
+		p.anyStart = true
+		p.key = p.key[1:]
+	}
+	if strings.HasSuffix(p.key, "*") {
+		p.anyEnd = true
+		p.key = p.key[:len(p.key)-1]
+	}
+	if p.key == "" {
+		return ParsedKey{}, fmt.Errorf("invalid key '%s'", k)
+	}
+	for i := 0; i < len(p.key); {
+		r, size := utf8.DecodeRuneInString(p.key[i:])
+		if r < utf8.RuneSelf && !c.isKeyChar(p.key[i]) || r >= utf8.RuneSelf && !isWordRune(r) {
+			return ParsedKey{}, fmt.Errorf("invalid key '%s'", k)
 		}
+		i += size
+	}
+	return p, nil
+}
 
-		p = append(p, ParsedKey{
-			key:      k,
-			anyEnd:   anyEnd,
-			anyStart: anyStart,
-		})
+// NewTrie returns an empty trie of the rules.
+func NewTrie(rules map[string]*Rule) *Trie {
+	return newTrie(rules, defaultKeyChars)
+}
+
+// newTrie returns an empty trie of the rules, whose keys may contain the
+// given characters.
+func newTrie(rules map[string]*Rule, chars *keyChars) *Trie {
+	root := &TrieNode{}
+	if rules == nil {
+		rules = make(map[string]*Rule)
 	}
+	return &Trie{
+		Nodes:  append(make([]*TrieNode, 0, 512), root),
+		Trie:   root,
+		Rules:  rules,
+		depths: []int{1},
+		chars:  chars,
 
-	return p
+		allStale: true,
+	}
 }
 
 // ConstructTrie constructs a trie from a map of rules.
 // It ensures that the generated trie is consistent each time.
-// When "abc", "*abc", "abc*", and "*abc*" exists, keeps only "*abc*".
+// When "abc", "*abc", "abc*", and "*abc*" exists, they share a node, and
+// "abc" only matches where its rule has a higher priority than "*abc*".
+// When a key belongs to multiple rules, the rule with the highest priority
+// keeps it, then the rule with the smallest name.
 func ConstructTrie(rules map[string]*Rule) *Trie {
+	return constructTrie(rules, defaultKeyChars)
+}
+
+// constructTrie is like ConstructTrie, but the keys may contain the given
+// characters.
+func constructTrie(rules map[string]*Rule, chars *keyChars) *Trie {
 
 	krMap := make(map[string]*Rule)
-	for _, r := range rules {
+	for _, name := range OrderedMapKeys(rules) {
+		r := rules[name]
 		for _, key := range r.Keys {
-			krMap[key] = r
+			key = r.normalizeKey(key)
+			if x, ok := krMap[key]; !ok || precedes(r, x) {
+				krMap[key] = r
+			}
 		}
 	}
 
 	// reorders the rule keys, so the trie is consistent each time.
-	p := sortRuleKeys(len(krMap), func() func() (string, bool) {
-		keys := OrderedMapKeys(krMap)
-		sort.Slice(keys, func(i, j int) bool {
-			if len(keys[i]) < len(keys[j]) {
-				return true
+	keys := OrderedMapKeys(krMap)
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) < len(keys[j]) {
+			return true
+		}
+		if len(keys[i]) > len(keys[j]) {
+			return false
+		}
+		return keys[i] < keys[j]
+	})
+
+	trie := newTrie(rules, chars)
+	for _, key := range keys {
+		_ = trie.insert(key, krMap[key]) // the keys are checked by MergeRules
+	}
+	trie.updatePreferred()
+	return trie
+}
+
+// cloneRules returns a copy of the rules, the rules are copied too, so the
+// copies can be modified without affecting the readers of the originals.
+func cloneRules(rules map[string]*Rule) map[string]*Rule {
+	m := make(map[string]*Rule, len(rules))
+	for name, r := range rules {
+		c := *r
+		c.Keys = slices.Clone(r.Keys)
+		m[name] = &c
+	}
+	return m
+}
+
+// clone returns a deep copy of the trie whose nodes refer to the rules of
+// the same names in rules, so the copy can be modified without affecting
+// the readers of the trie. The nodes and their slices are allocated in
+// blocks, the slices are capped, so appending to them reallocates.
+func (t *Trie) clone(rules map[string]*Rule) *Trie {
+	ruleOf := func(r *Rule) *Rule {
+		if c, ok := rules[r.Name]; ok {
+			return c
+		}
+		return r
+	}
+	var children, variants, preferred int
+	for _, n := range t.Nodes {
+		for _, child := range n.Child {
+			children += len(child)
+		}
+		if n.variants != nil {
+			variants++
+		}
+		preferred += len(n.preferred)
+	}
+	var (
+		nodeBlock      = make([]TrieNode, len(t.Nodes))
+		childBlock     = make([]CharState, 0, children)
+		variantBlock   = make([][4]variantKeys, 0, variants)
+		preferredBlock = make([]preferredKey, 0, preferred)
+	)
+	// grow appends the elements to the block, and returns them capped.
+	grow := func(block *[]CharState, elems []CharState) []CharState {
+		i := len(*block)
+		*block = append(*block, elems...)
+		return (*block)[i:len(*block):len(*block)]
+	}
+
+	nodes := make([]*TrieNode, len(t.Nodes))
+	for i, n := range t.Nodes {
+		nodeBlock[i] = *n
+		nodes[i] = &nodeBlock[i]
+	}
+	for _, n := range nodes {
+		for i, child := range n.Child {
+			if len(child) == 0 {
+				continue
 			}
-			if len(keys[i]) > len(keys[j]) {
-				return false
+			child = grow(&childBlock, child)
+			for j := range child {
+				child[j].State = nodes[child[j].State.State]
 			}
-			return keys[i] < keys[j]
-		})
-		i := -1
-		return func() (string, bool) { // implements an iterator.
-			i++
-			if i < len(keys) {
-				return keys[i], true
+			n.Child[i] = child
+		}
+		if n.LastEnd != nil {
+			n.LastEnd = nodes[n.LastEnd.State]
+		}
+		if n.Rule != nil {
+			n.Rule = ruleOf(n.Rule)
+		}
+		if n.variants != nil {
+			variantBlock = append(variantBlock, *n.variants)
+			vs := &variantBlock[len(variantBlock)-1]
+			for v, vk := range vs {
+				if vk.rule != nil {
+					vs[v].rule = ruleOf(vk.rule)
+				}
+				vs[v].exact = slices.Clone(vk.exact)
+				for i, e := range vs[v].exact {
+					vs[v].exact[i].rule = ruleOf(e.rule)
+				}
+			}
+			n.variants = vs
+		}
+		if len(n.preferred) > 0 {
+			i := len(preferredBlock)
+			for _, k := range n.preferred {
+				k.node = nodes[k.node.State]
+				preferredBlock = append(preferredBlock, k)
 			}
-			return "", false
+			n.preferred = preferredBlock[i:len(preferredBlock):len(preferredBlock)]
 		}
-	}())
+	}
+	return &Trie{
+		Nodes:       nodes,
+		Trie:        nodes[0],
+		MaxDepth:    t.MaxDepth,
+		Rules:       rules,
+		depths:      slices.Clone(t.depths),
+		chars:       t.chars,
+		maxPriority: t.maxPriority,
+	}
+}
 
-	trie := &TrieNode{}
-	nodes := make([]*TrieNode, 0, 512)
-	nodes = append(nodes, trie)
+// precedes reports whether rule a takes precedence over rule b when
+// they claim the same key, the rule with the higher priority wins, then
+// the rule with the smaller name.
+func precedes(a, b *Rule) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Name < b.Name
+}
 
-	stateIndex := 1
-	for i := 0; i < len(p); i++ {
-		var lastEnd *TrieNode
-		currState := 0
-		j := 0
+// variantRule returns the rule of a node from its key variants, the rule
+// with the highest priority wins, then the most general variant, "*abc*"
+// is preferred over "*abc", then "abc*" and "abc".
+func variantRule(variants *[4]*Rule) *Rule {
+	var rule *Rule
+	for _, v := range [...]int{variantAnyBoth, variantAnyStart, variantAnyEnd, variantExact} {
+		if r := variants[v]; r != nil && (rule == nil || r.Priority > rule.Priority) {
+			rule = r
+		}
+	}
+	return rule
+}
 
-		// skips the existing prefixes.
-		for ; j < len(p[i].key); j++ {
-			r := getNextNode(nodes[currState], p[i].key[j])
-			if r == nil {
-				break
-			}
-			currState = r.State
-			if r.End { // pointers to the last terminal nodes.
-				lastEnd = r
+// updatePriority updates the upper bound of the priorities of the rules.
+func (t *Trie) updatePriority() {
+	t.maxPriority = 0
+	for _, r := range t.Rules {
+		t.maxPriority = max(t.maxPriority, r.Priority)
+	}
+}
+
+// Insert inserts the key of the rule into the trie. The key may have
+// wildcards at both ends, the nodes are shared by the variants of a key,
+// and the pointers to the last terminal nodes are kept. When the key
+// already belongs to another rule, the rule taking precedence keeps it.
+func (t *Trie) Insert(key string, r *Rule) error {
+	if err := t.insert(key, r); err != nil {
+		return err
+	}
+	t.updatePreferred()
+	return nil
+}
+
+// insert is like Insert, but it leaves the preferred keys to the caller,
+// which updates them once after a batch of changes.
+func (t *Trie) insert(key string, r *Rule) error {
+	k, err := t.chars.parseKey(key)
+	if err != nil {
+		return err
+	}
+	if x, ok := t.Rules[r.Name]; ok && x != r {
+		return fmt.Errorf("another rule named '%s' exists", r.Name)
+	} else if !ok && r.Name != "" {
+		t.Rules[r.Name] = r
+	}
+	t.maxPriority = max(t.maxPriority, r.Priority)
+
+	n := t.Trie
+	for j := 0; j < len(k.key); j++ {
+		next := t.getNextNode(n, k.key[j])
+		if next == nil {
+			next = t.newNode(j + 1)
+			next.LastEnd = n.LastEnd
+			if n.End {
+				next.LastEnd = n
 			}
+			t.setNextNode(n, k.key[j], next)
+			t.markStale(staleNode{node: next, path: k.key[:j+1]})
+		}
+		n = next
+	}
+
+	if n.variants == nil {
+		n.variants = new([4]variantKeys)
+	}
+	ranked, anyStart := n.ranked(), n.AnyStart
+	vk := &n.variants[k.variant()]
+	if r.CaseSensitive {
+		s := k.exact(key)
+		if i := vk.indexExact(s); i < 0 {
+			vk.exact = append(vk.exact, exactKey{s, r})
+		} else if x := vk.exact[i].rule; x == r || !precedes(x, r) {
+			vk.exact[i].rule = r
+		} else {
+			return nil
+		}
+	} else {
+		if x := vk.rule; x != nil && x != r && precedes(x, r) {
+			return nil
+		}
+		vk.rule = r
+	}
+	if end := n.End; n.updateEnd() && !end {
+		setLastEnd(n, n) // the node becomes the last terminal node of its subtree.
+	}
+	t.markRanked(n, k.key, ranked, anyStart)
+	return nil
+}
+
+// Delete deletes the key from the trie, and removes the nodes leading to
+// no key. It reports whether the key was in the trie. The key in the exact
+// case of a case-sensitive rule is deleted first, then the key of the
+// case-insensitive rule.
+func (t *Trie) Delete(key string) bool {
+	r := t.Lookup(key)
+	if r == nil || !t.remove(key, r) {
+		return false
+	}
+	t.updatePreferred()
+	return true
+}
+
+// remove is like Delete, but it deletes the key of the rule r, and leaves
+// the preferred keys to the caller, like insert.
+func (t *Trie) remove(key string, r *Rule) bool {
+	k, err := t.chars.parseKey(key)
+	if err != nil {
+		return false
+	}
+
+	path := make([]*TrieNode, 1, len(k.key)+1)
+	path[0] = t.Trie
+	for j := 0; j < len(k.key); j++ {
+		n := t.getNextNode(path[j], k.key[j])
+		if n == nil {
+			return false
+		}
+		path = append(path, n)
+	}
+
+	n := path[len(path)-1]
+	if n.variants == nil {
+		return false
+	}
+	ranked, anyStart := n.ranked(), n.AnyStart
+	vk := &n.variants[k.variant()]
+	if r.CaseSensitive { // deletes only the key in the exact case.
+		i := vk.indexExact(k.exact(key))
+		if i < 0 || vk.exact[i].rule != r {
+			return false
+		}
+		vk.exact = slices.Delete(vk.exact, i, i+1)
+	} else {
+		if vk.rule != r {
+			return false
 		}
+		vk.rule = nil
+	}
+	if !n.updateEnd() {
+		setLastEnd(n, n.LastEnd)
+	}
+	t.markRanked(n, k.key, ranked, anyStart)
 
-		// handles the non-existent parts.
-		for ; j < len(p[i].key); j++ {
-			n := &TrieNode{
-				State:   stateIndex,
-				Depth:   j + 1,
-				LastEnd: lastEnd, // the nearest terminal node.
+	// removes the nodes leading to no key, from the bottom up.
+	for j := len(path) - 1; j > 0; j-- {
+		c := path[j]
+		if c.End || c.ChildBitMap != [4]uint64{} {
+			break
+		}
+		t.removeNextNode(path[j-1], k.key[j-1])
+		t.removeNode(c)
+	}
+	return true
+}
+
+// Lookup returns the rule of the key in the trie, or nil if not found.
+func (t *Trie) Lookup(key string) *Rule {
+	k, err := t.chars.parseKey(key)
+	if err != nil {
+		return nil
+	}
+	n := t.node(k.key)
+	if n == nil || n.variants == nil {
+		return nil
+	}
+	return n.variants[k.variant()].ruleFor([]byte(k.exact(key)))
+}
+
+// node returns the node of the key without wildcards, or nil if not found.
+func (t *Trie) node(key string) *TrieNode {
+	n := t.Trie
+	for j := 0; j < len(key) && n != nil; j++ {
+		n = t.getNextNode(n, key[j])
+	}
+	return n
+}
+
+// updateEnd derives the terminal state of the node from its key variants,
+// and reports whether it's a terminal node. The flags tell whether any
+// variant has the wildcards, and the rule is decided by variantRule among
+// the owners taking precedence in each variant, which is the upper bound of
+// the rules matching at the node.
+func (n *TrieNode) updateEnd() bool {
+	n.End, n.AnyStart, n.AnyEnd, n.Rule, n.exact = false, false, false, nil, false
+	if n.variants == nil {
+		return false
+	}
+	var tops [4]*Rule
+	for v := range n.variants {
+		vk := &n.variants[v]
+		if vk.empty() {
+			continue
+		}
+		tops[v] = vk.top()
+		n.End = true
+		n.AnyStart = n.AnyStart || v&variantAnyStart != 0
+		n.AnyEnd = n.AnyEnd || v&variantAnyEnd != 0
+		n.exact = n.exact || len(vk.exact) > 0
+	}
+	if !n.End {
+		n.variants = nil
+		return false
+	}
+	n.Rule = variantRule(&tops)
+	return true
+}
+
+// variantOrder is the order in which the variants of a node are tried, the
+// most general first, so it wins the ties of priorities.
+var variantOrder = [...]int{variantAnyBoth, variantAnyStart, variantAnyEnd, variantExact}
+
+// match returns the rule of the node matching the key b[start:end+1] and
+// its variant, among the variants having the wildcards in need. Each variant
+// is checked by the key filter with its own wildcards, and the rule with the
+// highest priority wins, then the most general variant. A case-sensitive
+// rule only matches its keys in their exact case.
+func (n *TrieNode) match(b []byte, start, end int, f KeyFilter, need int) (rule *Rule, variant int) {
+	for _, v := range variantOrder {
+		if v&need != need {
+			continue
+		}
+		vk := &n.variants[v]
+		r := vk.rule
+		if n.exact {
+			r = vk.ruleFor(b[start : end+1])
+		}
+		if r == nil || rule != nil && r.Priority <= rule.Priority {
+			continue
+		}
+		if f == nil || f(b, start, end, v&variantAnyStart != 0, v&variantAnyEnd != 0) {
+			rule, variant = r, v
+		}
+	}
+	return rule, variant
+}
+
+// subsumer returns the most general variant of the node subsuming the key
+// of the variant v, having its wildcards and a rule of no lower priority, so
+// the key never matches as v. It returns -1 if there is none.
+func (n *TrieNode) subsumer(key []byte, v int) int {
+	r := n.variants[v].ruleFor(key)
+	for _, w := range variantOrder {
+		if w == v || w&v != v {
+			continue
+		}
+		if o := n.variants[w].ruleFor(key); o != nil && o.Priority >= r.Priority {
+			return w
+		}
+	}
+	return -1
+}
+
+// owner is like match, but it ignores the key filter.
+func (n *TrieNode) owner(key []byte, need int) (rule *Rule, variant int) {
+	for _, v := range variantOrder {
+		if r := n.variants[v].ruleFor(key); r != nil && v&need == need && (rule == nil || r.Priority > rule.Priority) {
+			rule, variant = r, v
+		}
+	}
+	return rule, variant
+}
+
+// setLastEnd points the descendants of the node to the terminal node end,
+// until reaching other terminal nodes.
+func setLastEnd(n *TrieNode, end *TrieNode) {
+	for _, child := range n.Child {
+		for _, c := range child {
+			if c.Char >= 'A' && c.Char <= 'Z' { // shares the node of the lowercase.
+				continue
+			}
+			c.State.LastEnd = end
+			if !c.State.End {
+				setLastEnd(c.State, end)
 			}
-			setNextNode(nodes[currState], p[i].key[j], n)
-			nodes = append(nodes, n)
-			currState = stateIndex
-			stateIndex++
 		}
+	}
+}
 
-		nodes[currState].End = true
-		nodes[currState].Rule = krMap[p[i].Key()]
-		nodes[currState].AnyStart = p[i].anyStart
-		nodes[currState].AnyEnd = p[i].anyEnd
+// newNode appends a new node of the depth.
+func (t *Trie) newNode(depth int) *TrieNode {
+	n := &TrieNode{State: len(t.Nodes), Depth: depth}
+	t.Nodes = append(t.Nodes, n)
+	for len(t.depths) <= depth {
+		t.depths = append(t.depths, 0)
 	}
+	t.depths[depth]++
+	t.MaxDepth = max(t.MaxDepth, depth)
+	return n
+}
 
-	return &Trie{nodes, trie}
+// removeNode removes the node, the last node takes its state.
+func (t *Trie) removeNode(n *TrieNode) {
+	last := t.Nodes[len(t.Nodes)-1]
+	last.State = n.State
+	t.Nodes[n.State] = last
+	t.Nodes[len(t.Nodes)-1] = nil
+	t.Nodes = t.Nodes[:len(t.Nodes)-1]
+	t.depths[n.Depth]--
+	for t.MaxDepth > 0 && t.depths[t.MaxDepth] == 0 {
+		t.MaxDepth--
+	}
 }
 
 // Position represents the start and end positions of a matched rule.
 type Position struct {
-	Start int
-	End   int
-	Rule  *Rule
+	Start    int
+	End      int
+	Rule     *Rule
+	WinStart int // start of the masking window, set by the overlap policy
+	WinEnd   int // end of the masking window, set by the overlap policy
 }
 
-// MatchSleep just for test
-var MatchSleep func()
+// MatchStep describes a key candidate of the trie walk, that is, where the
+// walk stopped inside the trie. It is passed to the trace hook of MatchFunc.
+type MatchStep struct {
+	Node      *TrieNode // the node where the walk stopped
+	Pos       int       // position of the last walked byte
+	Match     Position  // the match of the candidate, valid if Matched
+	Matched   bool      // whether the candidate is accepted
+	Preferred bool      // whether a key of higher priority takes precedence
+	End       bool      // whether the walk reached the end of input inside a key
+}
 
 // Match performs a match operation on the given byte slice using the trie.
-// It returns a list of matched positions and rules, and a boolean indicating
-// that whether the operation was intercepted.
-func (t *Trie) Match(b []byte, f KeyFilter, maxTime int64) ([]Position, bool) {
+// It returns a list of matched positions and rules, the position where the
+// scan stopped, and the reason why the operation stopped, which is StopNone
+// when the whole slice was scanned. The bytes before the stop position are
+// fully scanned, and the bytes after it may contain unmatched keys.
+func (t *Trie) Match(b []byte, f KeyFilter, budget *Budget) ([]Position, int, StopReason) {
 	result := make([]Position, 0, 8)
-	startTime := MicroNow()
+	pos, reason := t.MatchFunc(b, f, budget, nil, func(p Position) bool {
+		result = append(result, p)
+		return true
+	})
+	return result, pos, reason
+}
+
+// MatchFunc is like Match, but it calls yield for each matched position
+// instead of collecting them, and stops when yield returns false. If trace
+// is not nil, it is called with each key candidate, accepted or not.
+func (t *Trie) MatchFunc(b []byte, f KeyFilter, budget *Budget, trace func(MatchStep), yield func(Position) bool) (int, StopReason) {
+	fast := trace == nil && t.maxPriority == 0 // no key takes precedence by priority.
+	matched := 0
 	current := t.Nodes[0]
 	tLength := len(b)
+	if budget.maxBytes > 0 && budget.maxBytes < tLength {
+		tLength = budget.maxBytes
+	}
 	pos := 0
 	for {
 		count := 0
@@ -299,79 +819,307 @@ func (t *Trie) Match(b []byte, f KeyFilter, maxTime int64) ([]Position, bool) {
 			if count > 128 {
 				break
 			}
-			n := getNextNode(current, b[pos])
+			n := t.getNextNode(current, b[pos])
 			if n != nil {
 				current = n
 			} else {
 				if current.Depth == 0 {
 					continue
 				}
-				r, ok := testMatch(b, current, pos-1, f)
+				var (
+					r  Position
+					ok bool
+				)
+				if fast {
+					r, ok = testMatch(b, current, pos-1, f)
+				} else {
+					var preferred bool
+					r, ok, preferred = t.matchAt(b, current, pos-1, f)
+					if trace != nil {
+						trace(MatchStep{Node: current, Pos: pos - 1, Match: r, Matched: ok, Preferred: preferred})
+					}
+				}
 				if ok {
-					result = append(result, r)
+					// exits if one more match than allowed is found.
+					if budget.maxMatches > 0 && matched >= budget.maxMatches {
+						return r.Start, StopMatchLimit
+					}
+					matched++
+					if !yield(r) {
+						return pos, StopNone
+					}
+				} else if t.chars.extra != "" {
+					// the extra key chars are splitters too, so a rejected key may
+					// hide the keys after them, e.g. "phone" in "xuser.phone", the
+					// walk restarts after the first one.
+					for i := pos - current.Depth; i < pos; i++ {
+						if !defaultKeyChars.isKeyChar(b[i]) {
+							pos = i
+							break
+						}
+					}
 				}
 				current = t.Nodes[0]
 			}
 		}
 		if pos >= tLength {
+			if trace != nil && current.Depth > 0 {
+				trace(MatchStep{Node: current, Pos: pos - 1, End: true})
+			}
 			break
 		}
-		if MatchSleep != nil { // just for test
-			MatchSleep()
-		}
-		// exits if the allowed maximum time is exceeded.
-		if MicroNow()-startTime > maxTime {
-			return result, true
+		// exits if the budget is exhausted.
+		if reason := budget.Check(); reason != StopNone {
+			return pos, reason
 		}
 	}
-	return result, false
+	if tLength < len(b) {
+		return tLength, StopByteLimit
+	}
+	return tLength, StopNone
 }
 
 // testMatch checks if the current node matches a rule.
 // It returns the matched position and rule if the match is successful.
 func testMatch(b []byte, c *TrieNode, pos int, f KeyFilter) (Position, bool) {
 
+	start := pos - c.Depth + 1
 	if c.End { // could be an exact match or a prefix match.
-		p := Position{pos - c.Depth + 1, pos, c.Rule}
-		if f == nil || f(b, p.Start, p.End, c.AnyStart, c.AnyEnd) {
-			return p, true
+		if r, _ := c.match(b, start, pos, f, 0); r != nil {
+			return Position{Start: start, End: pos, Rule: r}, true
+		}
+		if r, _ := c.owner(b[start:pos+1], 0); r != nil {
+			return Position{}, false // a key rejected by the filter doesn't fall back.
 		}
-		return Position{}, false
 	}
 
 	lastEnd := c.LastEnd // must be a prefix match.
 	if lastEnd == nil || !lastEnd.AnyEnd {
 		return Position{}, false
 	}
-	p := Position{pos - c.Depth + 1, pos - (c.Depth - lastEnd.Depth), lastEnd.Rule}
-	if f == nil || f(b, p.Start, p.End, lastEnd.AnyStart, lastEnd.AnyEnd) {
-		return p, true
+	end := start + lastEnd.Depth - 1
+	if r, _ := lastEnd.match(b, start, end, f, variantAnyEnd); r != nil {
+		return Position{Start: start, End: end, Rule: r}, true
 	}
 	return Position{}, false
 }
 
+// matchAt is like testMatch, but a key of a rule with higher priority that
+// also matches the walked span takes precedence, see preferredMatch. It
+// reports whether such a key takes precedence.
+func (t *Trie) matchAt(b []byte, c *TrieNode, pos int, f KeyFilter) (_ Position, ok bool, preferred bool) {
+	p, ok := testMatch(b, c, pos, f)
+	baseline := 0
+	if ok {
+		baseline = p.Rule.Priority
+	}
+	if t.maxPriority > baseline {
+		if q, found := t.preferredMatch(b, c, pos, f, baseline); found {
+			return q, true, true
+		}
+	}
+	return p, ok, false
+}
+
+// preferredMatch looks for the key of the highest priority above baseline
+// matching the walked span ending at pos, that is, a prefix key with an
+// end wildcard, or a suffix key with a start wildcard. Ties are decided by
+// the longer key, then the earlier one. The candidates are collected by
+// updatePreferred, in the order of the upper bounds of their priorities.
+func (t *Trie) preferredMatch(b []byte, c *TrieNode, pos int, f KeyFilter, baseline int) (Position, bool) {
+	var (
+		best  Position
+		found bool
+	)
+	start := pos - c.Depth + 1
+	for _, k := range c.preferred {
+		n := k.node
+		if n.Rule.Priority <= baseline || found && n.Rule.Priority < best.Rule.Priority {
+			break // the remaining keys can't take precedence.
+		}
+		s, e := start+k.offset, start+k.offset+n.Depth-1
+		r, _ := n.match(b, s, e, f, k.need)
+		if r == nil || r.Priority <= baseline || found && !outranks(r, s, e, best) {
+			continue
+		}
+		best, found = Position{Start: s, End: e, Rule: r}, true
+	}
+	return best, found
+}
+
+// outranks reports whether the key of the rule r at [s,e] takes precedence
+// over the match p, by a higher priority, then the longer key, then the
+// earlier one.
+func outranks(r *Rule, s, e int, p Position) bool {
+	if r.Priority != p.Rule.Priority {
+		return r.Priority > p.Rule.Priority
+	}
+	if e-s != p.End-p.Start {
+		return e-s > p.End-p.Start
+	}
+	return s < p.Start
+}
+
+// ranked reports whether the node has a key of a rule with a priority,
+// which may take precedence over the other keys, see preferredMatch.
+func (n *TrieNode) ranked() bool {
+	return n.End && n.Rule.Priority > 0
+}
+
+// markStale records the changed node for updatePreferred. Nothing is
+// recorded when all the nodes are stale, or no rule has a priority.
+func (t *Trie) markStale(s staleNode) {
+	if !t.allStale && t.maxPriority > 0 {
+		t.stale = append(t.stale, s)
+	}
+}
+
+// markRanked records the node whose key has changed, if the key was ranked
+// before the change or is ranked after it.
+func (t *Trie) markRanked(n *TrieNode, path string, ranked, anyStart bool) {
+	if ranked || n.ranked() {
+		t.markStale(staleNode{n, path, true, ranked && anyStart || n.ranked() && n.AnyStart})
+	}
+}
+
+// updatePreferred collects the candidates of preferredMatch for the nodes
+// changed since the last update. They only depend on the path to the node,
+// so they are collected when the trie changes instead of being searched on
+// every failed walk. A new node collects its own candidates, and a ranked
+// key changes the candidates of the nodes below it, and of the nodes whose
+// path contains it if it has a start wildcard. Only the ranked keys are
+// candidates, so nothing is collected if no rule has a priority.
+func (t *Trie) updatePreferred() {
+	if t.allStale {
+		t.stale, t.allStale = nil, false
+		if t.maxPriority > 0 {
+			t.walkPreferred(t.Trie, make([]byte, 0, t.MaxDepth), nil)
+		}
+		return
+	}
+	var contained [][]byte
+	for _, s := range t.stale {
+		if !s.ranked {
+			s.node.preferred = t.collectPreferred(s.node, []byte(s.path))
+			continue
+		}
+		if n := t.node(s.path); n != nil {
+			t.walkPreferred(n, append(make([]byte, 0, t.MaxDepth), s.path...), nil)
+		}
+		if s.anyStart {
+			contained = append(contained, []byte(s.path))
+		}
+	}
+	if len(contained) > 0 {
+		t.walkPreferred(t.Trie, make([]byte, 0, t.MaxDepth), func(path []byte) bool {
+			for _, key := range contained {
+				if len(path) > 1 && bytes.Contains(path[1:], key) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	t.stale = nil
+}
+
+// walkPreferred collects the candidates of preferredMatch for the nodes of
+// the subtree of n whose path is accepted by stale, or all of them if nil.
+func (t *Trie) walkPreferred(n *TrieNode, path []byte, stale func(path []byte) bool) {
+	if n.Depth > 0 && (stale == nil || stale(path)) {
+		n.preferred = t.collectPreferred(n, path)
+	}
+	for _, child := range n.Child {
+		for _, c := range child {
+			if c.Char < 'A' || c.Char > 'Z' { // the uppercase shares the node
+				t.walkPreferred(c.State, append(path, c.Char), stale)
+			}
+		}
+	}
+}
+
+// collectPreferred returns the ranked keys matching the path of the node c,
+// that is, the key of c, the prefix keys with an end wildcard, and the
+// suffix keys with a start wildcard, sorted by the upper bounds of their
+// priorities, then the longer key, then the earlier one.
+func (t *Trie) collectPreferred(c *TrieNode, path []byte) []preferredKey {
+	var keys []preferredKey
+	for n := c; n != nil; n = n.LastEnd {
+		if n == c && n.ranked() {
+			keys = append(keys, preferredKey{n, 0, 0})
+		} else if n != c && n.ranked() && n.AnyEnd {
+			keys = append(keys, preferredKey{n, 0, variantAnyEnd})
+		}
+	}
+	for s := 1; s < len(path); s++ {
+		n := t.Trie
+		for i := s; i < len(path) && n != nil; i++ {
+			if n = t.getNextNode(n, path[i]); n != nil && n.ranked() && n.AnyStart && (i == len(path)-1 || n.AnyEnd) {
+				need := variantAnyStart
+				if i < len(path)-1 {
+					need = variantAnyBoth
+				}
+				keys = append(keys, preferredKey{n, s, need})
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.node.Rule.Priority != b.node.Rule.Priority {
+			return a.node.Rule.Priority > b.node.Rule.Priority
+		}
+		if a.node.Depth != b.node.Depth {
+			return a.node.Depth > b.node.Depth
+		}
+		return a.offset < b.offset
+	})
+	return keys
+}
+
 // DumpTrie outputs all keys reverse-parsed from the prefix tree.
-// It returns a sorted list of all keys presented in the trie.
+// It returns a sorted list of all keys presented in the trie. The keys
+// of case-sensitive rules are in their exact case, others in lower case.
 func (t *Trie) DumpTrie() []string {
-	m := make(map[string]struct{})
+	m := make(map[string]*Rule)
 	dumpTrie(t.Trie, "", m)
 	return OrderedMapKeys(m)
 }
 
-func dumpTrie(n *TrieNode, prefix string, m map[string]struct{}) {
+// DumpTrieRules is like DumpTrie, but it returns the name of the rule that
+// wins each key, after the priorities and the wildcard variants are applied.
+func (t *Trie) DumpTrieRules() map[string]string {
+	m := make(map[string]*Rule)
+	dumpTrie(t.Trie, "", m)
+	result := make(map[string]string, len(m))
+	for k, r := range m {
+		result[k] = r.Name
+	}
+	return result
+}
+
+// dumpTrie collects the keys of the subtree and the rules winning them. The
+// keys of the case-sensitive rules are in their exact case, the others are
+// in lower case.
+func dumpTrie(n *TrieNode, prefix string, m map[string]*Rule) {
 	if n.End {
-		s := strings.ToLower(prefix)
-		if n.AnyStart {
-			s = "*" + s
-		}
-		if n.AnyEnd {
-			s += "*"
+		for v, vk := range n.variants {
+			var keys []string
+			if vk.rule != nil {
+				keys = append(keys, lowerKey(prefix))
+			}
+			for _, e := range vk.exact {
+				keys = append(keys, e.key)
+			}
+			for _, s := range keys {
+				if n.subsumer([]byte(s), v) < 0 {
+					m[ParsedKey{s, v&variantAnyStart != 0, v&variantAnyEnd != 0}.Key()] = vk.ruleFor([]byte(s))
+				}
+			}
 		}
-		m[s] = struct{}{}
 	}
 	for _, child := range n.Child {
 		for _, c := range child {
-			dumpTrie(c.State, prefix+string(c.Char), m)
+			dumpTrie(c.State, prefix+string([]byte{c.Char}), m)
 		}
 	}
 }
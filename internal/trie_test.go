@@ -0,0 +1,566 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+)
+
+// dumpNodes describes every node reachable from the root by its path,
+// so that tries with different states can be compared.
+func dumpNodes(t *testing.T, trie *Trie) []string {
+	t.Helper()
+	paths := map[*TrieNode]string{trie.Trie: ""}
+	var result []string
+	var walk func(n *TrieNode, path string)
+	walk = func(n *TrieNode, path string) {
+		if trie.Nodes[n.State] != n {
+			t.Fatalf("node %q has state %d", path, n.State)
+		}
+		s := fmt.Sprintf("%q depth=%d end=%v any=%v,%v", path, n.Depth, n.End, n.AnyStart, n.AnyEnd)
+		if n.Rule != nil {
+			s += " rule=" + n.Rule.Name
+		}
+		if n.LastEnd != nil {
+			s += fmt.Sprintf(" last=%q", paths[n.LastEnd])
+		}
+		for _, k := range n.preferred {
+			s += fmt.Sprintf(" pref=%q", path[k.offset:k.offset+k.node.Depth])
+		}
+		result = append(result, s)
+		var chars []uint8
+		for _, child := range n.Child {
+			for _, c := range child {
+				chars = append(chars, c.Char)
+			}
+		}
+		sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+		for _, c := range chars {
+			if c >= 'A' && c <= 'Z' {
+				continue
+			}
+			next := trie.getNextNode(n, c)
+			paths[next] = path + string(c)
+			walk(next, path+string(c))
+		}
+	}
+	walk(trie.Trie, "")
+	if len(result) != len(trie.Nodes) {
+		t.Fatalf("got %d reachable nodes, expect %d", len(result), len(trie.Nodes))
+	}
+	return result
+}
+
+func TestTrieInsertDelete(t *testing.T) {
+	a := &Rule{Name: "a"}
+	b := &Rule{Name: "b"}
+	trie := NewTrie(nil)
+
+	mustInsert := func(key string, r *Rule) {
+		t.Helper()
+		if err := trie.Insert(key, r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mustInsert("abcde", a)
+	mustInsert("*AB*", b)
+	mustInsert("ab", a)
+	ab := trie.getNextNode(trie.getNextNode(trie.Trie, 'a'), 'b')
+	if !ab.End || !ab.AnyStart || !ab.AnyEnd || ab.Rule != b {
+		t.Fatalf("unexpected node %+v", ab)
+	}
+	n := trie.getNextNode(trie.getNextNode(ab, 'c'), 'd')
+	if n.LastEnd == nil || n.LastEnd.Depth != 2 || n.LastEnd.Rule != b {
+		t.Fatalf("got last end %+v, expect ab", n.LastEnd)
+	}
+	if got := trie.Lookup("ab"); got != a {
+		t.Fatalf("got %v, expect rule a", got)
+	}
+	if got := trie.Lookup("*ab*"); got != b {
+		t.Fatalf("got %v, expect rule b", got)
+	}
+
+	// the rule with the smaller name keeps the key.
+	mustInsert("abcde", b)
+	if got := trie.Lookup("abcde"); got != a {
+		t.Fatalf("got %v, expect rule a", got)
+	}
+
+	if trie.Delete("*ab") || trie.Delete("abc") || trie.Delete("x") {
+		t.Fatal("expect deleting absent keys fails")
+	}
+	if !trie.Delete("*ab*") {
+		t.Fatal("expect deleting *ab* succeeds")
+	}
+	if n.LastEnd == nil || n.LastEnd.AnyEnd || n.LastEnd.Rule != a {
+		t.Fatalf("got last end %+v, expect exact ab", n.LastEnd)
+	}
+	if !trie.Delete("ab") {
+		t.Fatal("expect deleting ab succeeds")
+	}
+	if n.LastEnd != nil {
+		t.Fatalf("got last end %+v, expect nil", n.LastEnd)
+	}
+	if !trie.Delete("abcde") || len(trie.Nodes) != 1 || trie.MaxDepth != 0 {
+		t.Fatalf("got %d nodes depth %d, expect only the root", len(trie.Nodes), trie.MaxDepth)
+	}
+	if trie.Trie.ChildBitMap != [4]uint64{} || len(trie.DumpTrie()) > 0 {
+		t.Fatalf("expect an empty trie, got %v", trie.DumpTrie())
+	}
+
+	if err := trie.Insert("a*b", a); err == nil {
+		t.Fatal("expect an error for the invalid key")
+	}
+}
+
+func TestTrieIncrementalEquivalence(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randKey := func() string {
+		const chars = "abc_1"
+		b := make([]byte, 1+rng.Intn(6))
+		for i := range b {
+			b[i] = chars[rng.Intn(len(chars))]
+		}
+		s := string(b)
+		if rng.Intn(4) == 0 {
+			s = "*" + s
+		}
+		if rng.Intn(4) == 0 {
+			s += "*"
+		}
+		return s
+	}
+
+	for round := 0; round < 20; round++ {
+		rules := map[string]*Rule{
+			"a": {Name: "a"}, "b": {Name: "b", Priority: 1}, "c": {Name: "c", Priority: -1},
+		}
+		names := OrderedMapKeys(rules)
+		trie := NewTrie(nil)
+
+		type pair struct {
+			key  string
+			rule *Rule
+		}
+		var pairs []pair
+		for i := 0; i < 300; i++ {
+			pairs = append(pairs, pair{randKey(), rules[names[rng.Intn(len(names))]]})
+		}
+		for _, p := range pairs {
+			if err := trie.Insert(p.key, p.rule); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		// deletes some keys, and inserts some of them back.
+		deleted := make(map[string]bool)
+		for _, p := range pairs {
+			if rng.Intn(3) == 0 && !deleted[p.key] {
+				if !trie.Delete(p.key) {
+					t.Fatalf("expect deleting %s succeeds", p.key)
+				}
+				deleted[p.key] = true
+			}
+		}
+		for _, p := range pairs {
+			if deleted[p.key] && rng.Intn(4) == 0 {
+				delete(deleted, p.key)
+				for _, q := range pairs {
+					if q.key == p.key {
+						_ = trie.Insert(q.key, q.rule)
+					}
+				}
+			}
+		}
+
+		for _, p := range pairs {
+			if !deleted[p.key] && !slices.Contains(p.rule.Keys, p.key) {
+				p.rule.Keys = append(p.rule.Keys, p.key)
+			}
+		}
+		want := ConstructTrie(rules)
+		got, expect := dumpNodes(t, trie), dumpNodes(t, want)
+		if !slices.Equal(got, expect) {
+			t.Fatalf("round %d: got %v, expect %v", round, got, expect)
+		}
+		if trie.MaxDepth != want.MaxDepth || !slices.Equal(trie.DumpTrie(), want.DumpTrie()) {
+			t.Fatalf("round %d: got %v, expect %v", round, trie.DumpTrie(), want.DumpTrie())
+		}
+	}
+}
+
+func TestTrieClone(t *testing.T) {
+	trie := ConstructTrie(testRules())
+	want := dumpNodes(t, trie)
+
+	rules := cloneRules(trie.Rules)
+	c := trie.clone(rules)
+	if got := dumpNodes(t, c); !slices.Equal(got, want) {
+		t.Fatalf("got %v, expect %v", got, want)
+	}
+	if c.Lookup("phone") != rules["phone"] || c.Lookup("*_content_*") != rules["phone"] {
+		t.Fatal("expect the clone refers to the cloned rules")
+	}
+
+	// modifies the clone, the trie is unchanged.
+	rules["phone"].Length = 10
+	if !c.Delete("p_prefix_*") || !c.Delete("id") {
+		t.Fatal("expect deleting the keys succeeds")
+	}
+	if err := c.Insert("phone2", rules["id"]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := dumpNodes(t, trie); !slices.Equal(got, want) {
+		t.Fatalf("got %v, expect %v", got, want)
+	}
+	if trie.Rules["phone"].Length != 30 || trie.Lookup("phone2") != nil {
+		t.Fatal("expect the trie unchanged")
+	}
+}
+
+func TestTriePriority(t *testing.T) {
+	a := &Rule{Name: "a", Keys: []string{"same"}}
+	d := &Rule{Name: "d", Keys: []string{"driver_phone", "driver*"}}
+	z := &Rule{Name: "z", Keys: []string{"same", "*_phone"}, Priority: 1}
+	rules := map[string]*Rule{"a": a, "d": d, "z": z}
+
+	match := func(trie *Trie, s string) []Position {
+		t.Helper()
+		arr, _, _ := trie.Match([]byte(s), DefaultKeyFilter, NewContextBudget(context.Background()))
+		return arr
+	}
+
+	trie := ConstructTrie(rules)
+	got := trie.DumpTrieRules()
+	expect := map[string]string{"same": "z", "*_phone": "z", "driver_phone": "d", "driver*": "d"}
+	if !maps.Equal(got, expect) {
+		t.Fatalf("got %v, expect %v", got, expect)
+	}
+	arr := match(trie, "driver_phone:12345678900")
+	if len(arr) != 1 || arr[0].Rule != z || arr[0].Start != 6 || arr[0].End != 11 {
+		t.Fatalf("got %+v, expect *_phone of rule z", arr)
+	}
+
+	// the higher priority of an end wildcard key wins the longer exact key.
+	d.Priority = 2
+	trie = ConstructTrie(rules)
+	arr = match(trie, "driver_phone:12345678900")
+	if len(arr) != 1 || arr[0].Rule != d || arr[0].Start != 0 || arr[0].End != 11 {
+		t.Fatalf("got %+v, expect driver_phone of rule d", arr)
+	}
+
+	// without priorities, the longest match and the smaller name win.
+	d.Priority, z.Priority = 0, 0
+	trie = ConstructTrie(rules)
+	if got = trie.DumpTrieRules(); got["same"] != "a" || got["*_phone"] != "z" {
+		t.Fatalf("got %v, expect same of rule a", got)
+	}
+	arr = match(trie, "driver_phone:12345678900, cell_phone:12345678900")
+	if len(arr) != 2 || arr[0].Rule != d || arr[0].Start != 0 || arr[1].Rule != z || arr[1].Start != 30 {
+		t.Fatalf("got %+v", arr)
+	}
+
+	// the variants of a node match with their own wildcards.
+	p := &Rule{Name: "p", Keys: []string{"phone"}, Priority: 10}
+	w := &Rule{Name: "w", Keys: []string{"*phone*"}}
+	trie = ConstructTrie(map[string]*Rule{"p": p, "w": w})
+	expect = map[string]string{"phone": "p", "*phone*": "w"}
+	if got = trie.DumpTrieRules(); !maps.Equal(got, expect) {
+		t.Fatalf("got %v, expect %v", got, expect)
+	}
+	arr = match(trie, "xphonex:123 phone:123")
+	if len(arr) != 2 || arr[0].Rule != w || arr[0].Start != 1 || arr[1].Rule != p || arr[1].Start != 12 {
+		t.Fatalf("got %+v, expect *phone* of rule w, then phone of rule p", arr)
+	}
+}
+
+func TestTriePreferredUpdate(t *testing.T) {
+	rules := map[string]*Rule{
+		"a": {Name: "a"},
+		"b": {Name: "b", Priority: 1},
+		"c": {Name: "c", Priority: 2},
+	}
+	names := []string{"a", "b", "c"}
+	keys := []string{"ab", "abc", "bc", "abcd", "cd", "bcd", "d"}
+	wildcards := []string{"%s", "*%s", "%s*", "*%s*"}
+
+	// the candidates collected after each change equal the ones of all nodes.
+	check := func(trie *Trie) {
+		t.Helper()
+		got := make([][]preferredKey, len(trie.Nodes))
+		for i, n := range trie.Nodes {
+			got[i] = n.preferred
+		}
+		trie.allStale = true
+		trie.updatePreferred()
+		for i, n := range trie.Nodes {
+			if !reflect.DeepEqual(got[i], n.preferred) {
+				t.Fatalf("node %d: got %v, expect %v", n.State, got[i], n.preferred)
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	trie := ConstructTrie(map[string]*Rule{"a": rules["a"]})
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf(wildcards[rnd.Intn(len(wildcards))], keys[rnd.Intn(len(keys))])
+		r := rules[names[rnd.Intn(len(names))]]
+		if rnd.Intn(3) == 0 {
+			trie.Delete(key)
+		} else if err := trie.Insert(key, r); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		check(trie)
+	}
+}
+
+func TestExtraKeyChars(t *testing.T) {
+	// the extra characters take the upper words of the bitmap.
+	var all []byte
+	for c := uint8(0); c < 128; c++ {
+		if IsExtraKeyChar(c) {
+			all = append(all, c)
+		}
+	}
+	chars := newKeyChars(string(all))
+	if chars.isKeyChar('*') || chars.table['~'] < 64 {
+		t.Fatalf("unexpected char table %v", chars.table)
+	}
+	trie := constructTrie(map[string]*Rule{"r": {Name: "r", Keys: []string{"a~b", "a}b"}}}, chars)
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"a}b", "a~b"}) || trie.Lookup("a~b") == nil {
+		t.Fatalf("got %v", got)
+	}
+	trie.Delete("a}b")
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"a~b"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	chars = newKeyChars(".[]$~.")
+	if chars.extra != "$.[]~" || !chars.isKeyChar('.') || chars.isKeyChar(':') {
+		t.Fatalf("unexpected char table %q %v", chars.extra, chars.table)
+	}
+	r := &Rule{Name: "r", Keys: []string{"user.phone", "headers[x-token]", "$.card", "phone", "a~b"}}
+	trie = constructTrie(map[string]*Rule{"r": r}, chars)
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"$.card", "a~b", "headers[x-token]", "phone", "user.phone"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	for _, c := range []struct {
+		src  string
+		keys []string
+	}{
+		{`{"user.phone":"138","$.card":"6222","phone":"139"}`, []string{"user.phone", "$.card", "phone"}},
+		{`level=info user.phone=138 headers[x-token]=abc A~B=1`, []string{"user.phone", "headers[x-token]", "A~B"}},
+		{`name.phone=138`, []string{"phone"}}, // the extra chars are still splitters.
+	} {
+		arr, _, _ := trie.Match([]byte(c.src), DefaultKeyFilter, NewContextBudget(context.Background()))
+		var keys []string
+		for _, p := range arr {
+			keys = append(keys, c.src[p.Start:p.End+1])
+		}
+		if !slices.Equal(keys, c.keys) {
+			t.Fatalf("%s: got %v, expect %v", c.src, keys, c.keys)
+		}
+	}
+
+	if _, err := defaultKeyChars.parseKey("user.phone"); err == nil {
+		t.Fatal("expect an error for the dotted key")
+	}
+}
+
+func TestUTF8Keys(t *testing.T) {
+	for _, k := range []string{"手机：号", "手机号\xff", "“id”"} {
+		if _, err := defaultKeyChars.parseKey(k); err == nil {
+			t.Fatalf("expect an error for the key %q", k)
+		}
+	}
+	if p, err := defaultKeyChars.parseKey("*Phone号码"); err != nil || p.key != "phone号码" || !p.anyStart {
+		t.Fatalf("got %+v, %v", p, err)
+	}
+
+	r := &Rule{Name: "r", Keys: []string{"手机号", "身份证号", "*证件号", "phone"}}
+	trie := ConstructTrie(map[string]*Rule{"r": r})
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"*证件号", "phone", "手机号", "身份证号"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	for _, c := range []struct {
+		src  string
+		keys []string
+	}{
+		{`手机号:13812345678`, []string{"手机号"}},
+		{`身份证号：110101199003074512，phone:13812345678`, []string{"身份证号", "phone"}},
+		{`“手机号”：13812345678, 用户证件号=110101199003074512`, []string{"手机号", "证件号"}},
+		{`用户手机号：13812345678 手机号码:13812345678 手机号a:1`, nil},
+		{`用户phone:13812345678`, []string{"phone"}},
+	} {
+		arr, _, _ := trie.Match([]byte(c.src), DefaultKeyFilter, NewContextBudget(context.Background()))
+		var keys []string
+		for _, p := range arr {
+			keys = append(keys, c.src[p.Start:p.End+1])
+		}
+		if !slices.Equal(keys, c.keys) {
+			t.Fatalf("%s: got %v, expect %v", c.src, keys, c.keys)
+		}
+	}
+}
+
+func TestTrieCaseSensitive(t *testing.T) {
+	a := &Rule{Name: "a", Keys: []string{"ID", "Token*"}, CaseSensitive: true}
+	b := &Rule{Name: "b", Keys: []string{"token"}}
+	trie := ConstructTrie(map[string]*Rule{"a": a, "b": b})
+	// the keys of both rules are dumped, though they share the node.
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"ID", "Token*", "token"}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := trie.DumpTrieRules(); got["Token*"] != "a" || got["token"] != "b" {
+		t.Fatalf("got %v", got)
+	}
+	if trie.Lookup("ID") != a || trie.Lookup("id") != nil || trie.Lookup("TOKEN") != b {
+		t.Fatal("unexpected lookup results")
+	}
+
+	match := func(trie *Trie) []string {
+		t.Helper()
+		src := "ID:1 id:2 Id:3 Token:4 token:5 TokenX:6 TOKEN:7"
+		arr, _, _ := trie.Match([]byte(src), DefaultKeyFilter, NewContextBudget(context.Background()))
+		var result []string
+		for _, p := range arr {
+			result = append(result, src[p.Start:p.End+1]+"="+p.Rule.Name)
+		}
+		return result
+	}
+	expect := []string{"ID=a", "Token=a", "token=b", "Token=a", "TOKEN=b"}
+	if got := match(trie); !slices.Equal(got, expect) {
+		t.Fatalf("got %v, expect %v", got, expect)
+	}
+
+	data, err := trie.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	loaded := &Trie{}
+	if err = loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := match(loaded); !slices.Equal(got, expect) || !loaded.Rules["a"].CaseSensitive {
+		t.Fatalf("got %v, expect %v", got, expect)
+	}
+
+	if trie.Delete("Id") || !trie.Delete("ID") || trie.Lookup("ID") != nil {
+		t.Fatal("expect deleting only the key in the exact case")
+	}
+	if got := trie.DumpTrie(); !slices.Equal(got, []string{"Token*", "token"}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// no allocation when matching the keys of the case-sensitive rule.
+	src := []byte("ID:1 Token:2")
+	budget := NewContextBudget(context.Background())
+	if n := testing.AllocsPerRun(10, func() {
+		_, _ = trie.MatchFunc(src, DefaultKeyFilter, budget, nil, func(Position) bool { return true })
+	}); n != 0 {
+		t.Fatalf("got %v allocations, expect 0", n)
+	}
+
+	// a case-insensitive rule shares the variant with the exact keys.
+	c := &Rule{Name: "c", Keys: []string{"id"}}
+	if err := trie.Insert("ID", a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := trie.Insert("id", c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if trie.Lookup("ID") != a || trie.Lookup("id") != c || trie.Lookup("Id") != c {
+		t.Fatal("expect the exact key first, then the case-insensitive one")
+	}
+	data, err = trie.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = loaded.UnmarshalBinary(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded.Lookup("ID").Name != "a" || loaded.Lookup("Id").Name != "c" {
+		t.Fatal("expect both owners restored")
+	}
+	if !trie.Delete("id") || trie.Lookup("ID") != a || trie.Lookup("id") != nil {
+		t.Fatal("expect deleting only the case-insensitive key")
+	}
+}
+
+// benchRules returns a rule with n generated keys.
+func benchRules(n int) map[string]*Rule {
+	r := &Rule{Name: "bench"}
+	for i := 0; i < n; i++ {
+		r.Keys = append(r.Keys, fmt.Sprintf("key_%x_%d", uint32(i)*2654435761, i%97))
+	}
+	return map[string]*Rule{r.Name: r}
+}
+
+func BenchmarkConstructTrie(b *testing.B) {
+	for _, n := range []int{10_000, 100_000} {
+		rules := benchRules(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ConstructTrie(rules)
+			}
+		})
+	}
+}
+
+func BenchmarkTrieInsertDelete(b *testing.B) {
+	for _, n := range []int{10_000, 100_000} {
+		rules := benchRules(n)
+		trie := ConstructTrie(rules)
+		r := rules["bench"]
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("new_key_%d", i)
+				if err := trie.Insert(key, r); err != nil {
+					b.Fatal(err)
+				}
+				if !trie.Delete(key) {
+					b.Fatal("expect deleting succeeds")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMergeRules(b *testing.B) {
+	defer cfg.Store(NewTrie(nil))
+	for _, n := range []int{10_000, 100_000} {
+		if err := MergeRules(benchRules(n)); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("new_key_%d", i)
+				if err := MergeRules(map[string]*Rule{"bench": {Keys: []string{key}}}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		cfg.Store(NewTrie(nil))
+	}
+}
@@ -15,6 +15,9 @@
 package masking
 
 import (
+	"context"
+	"time"
+
 	"github.com/lvan100/go-masking/internal"
 )
 
@@ -24,11 +27,88 @@ type Rule = internal.Rule
 // Masker masks the byte slice in-place.
 type Masker = internal.Masker
 
-// MergeRules merges new rules and reconstructs the trie.
+// MergeRules merges new rules and updates the trie. The trie is constructed
+// at the first time, then only the new keys are inserted into it. When a key
+// belongs to multiple rules, the rule with the highest Priority keeps it,
+// then the rule with the smallest name. An existing rule is updated with the
+// non-zero fields and the keys are added, set MergeOptions.Replace to replace
+// it instead. Changing the priority or the case sensitivity of an existing
+// rule, or replacing it, reconstructs the trie. The keys are inserted into a
+// copy of the trie, which then replaces it, so it's safe to merge while
+// masking. Copying takes time linear in the size of the trie, even for a
+// single key, so merge the rules in batches instead of one by one.
 func MergeRules(rules map[string]*Rule) error {
 	return internal.MergeRules(rules)
 }
 
+// MergeOptions configures MergeRulesReport. With Replace, the given rules
+// replace the existing ones of the same names, which resets the fields not
+// given, e.g. clears CaseSensitive, and drops the keys not given.
+type MergeOptions = internal.MergeOptions
+
+// MergeReport reports the keys added by a merge that are subsumed by more
+// general variants, claimed by multiple rules, or never matched.
+type MergeReport = internal.MergeReport
+
+// SubsumedKey is a key sharing a trie node with a more general variant of
+// no lower priority, so it never matches as itself.
+type SubsumedKey = internal.SubsumedKey
+
+// KeyConflict is a key claimed by multiple rules.
+type KeyConflict = internal.KeyConflict
+
+// UnreachableKey is a key that never matches in all the typical contexts,
+// such as `key:`, `"key":` and `key=`, as the key filter rejects it, or
+// other keys, e.g. of higher priorities, take precedence over it.
+type UnreachableKey = internal.UnreachableKey
+
+// ErrMergeDiagnostics is returned by MergeRulesReport in strict mode when
+// there is any diagnostic.
+var ErrMergeDiagnostics = internal.ErrMergeDiagnostics
+
+// MergeRulesReport is like MergeRules, but it also reports the diagnostics
+// of the keys added by the merge: keys subsumed by more general variants,
+// e.g. "abc" by "*abc*", keys claimed by multiple rules, and keys that can
+// never match with the key filter and the other keys. In strict mode, it
+// fails without merging if there is any diagnostic.
+func MergeRulesReport(rules map[string]*Rule, opts MergeOptions) (*MergeReport, error) {
+	return internal.MergeRulesReport(rules, opts)
+}
+
+// RemoveKeys removes the keys from the rule and the trie, without
+// reconstructing the trie. A key shared with other rules is handed
+// over to the one with the highest priority, then the smallest name.
+// Like MergeRules, it's safe to remove keys while masking.
+func RemoveKeys(rule string, keys ...string) error {
+	return internal.RemoveKeys(rule, keys)
+}
+
+// ErrInvalidTrie is returned by LoadTrie when the data is malformed,
+// corrupted, or of an unsupported version.
+var ErrInvalidTrie = internal.ErrInvalidTrie
+
+// MarshalTrie encodes the compiled trie and the rules into a versioned
+// binary form with a checksum. The maskers are not encoded, so the data
+// can be generated at build time and shipped with the rule set.
+func MarshalTrie() ([]byte, error) {
+	return internal.MarshalTrie()
+}
+
+// LoadTrie replaces the rules and the trie with the ones decoded from
+// the data produced by MarshalTrie, without reconstructing the trie, and
+// binds each rule to the masker of the same name in maskers. It returns
+// an error if the data is invalid, a rule has no masker, or the data allows
+// other extra key characters than SetExtraKeyChars sets, in which case the
+// current rules are kept.
+func LoadTrie(data []byte, maskers map[string]Masker) error {
+	return internal.LoadTrie(data, maskers)
+}
+
+// RuleNames returns the sorted names of all rules merged.
+func RuleNames() []string {
+	return internal.RuleNames()
+}
+
 // Mask masks the byte slice in-place. It accepts a maximum tolerable
 // time in microseconds, if the operation cost is over the maximum
 // tolerable time, then the operation is interrupted and returns true.
@@ -36,16 +116,279 @@ func Mask(t []byte, maxTolerable int64) (_ []byte, intercepted bool) {
 	return internal.Mask(t, maxTolerable)
 }
 
+// StopReason describes why a masking operation stopped.
+type StopReason = internal.StopReason
+
+const (
+	StopNone       = internal.StopNone       // the whole input was processed
+	StopDeadline   = internal.StopDeadline   // the time budget or deadline was exceeded
+	StopCanceled   = internal.StopCanceled   // the context was canceled
+	StopPanic      = internal.StopPanic      // a panic occurred during the operation
+	StopByteLimit  = internal.StopByteLimit  // the maximum bytes to scan was reached
+	StopMatchLimit = internal.StopMatchLimit // the maximum matches to find was reached
+)
+
+// Limits defines the budget of a masking operation. The byte and match
+// limits are deterministic, so the operation always stops at the same
+// point for the same input, unlike the time limit.
+type Limits = internal.Limits
+
+// MaskContext masks the byte slice in-place. The operation is interrupted
+// when the context is canceled or its deadline is exceeded, and the reason
+// is returned.
+func MaskContext(ctx context.Context, b []byte) ([]byte, StopReason) {
+	return internal.MaskContext(ctx, b)
+}
+
+// MaskLimits masks the byte slice in-place within the context and the
+// limits, and returns the reason why the operation stopped. The limits
+// can be combined, and the first exhausted one stops the operation.
+func MaskLimits(ctx context.Context, b []byte, l Limits) ([]byte, StopReason) {
+	return internal.MaskLimits(ctx, b, l)
+}
+
+// MaskPanic records a panic recovered during a masking operation.
+type MaskPanic = internal.MaskPanic
+
+// MaskResult reports the details of a masking operation.
+type MaskResult = internal.MaskResult
+
+// MaskEx masks the byte slice in-place within the context and the limits,
+// and returns the details of the operation, including the numbers of the
+// matches found and masked, the duration, the stop reason and the panics.
+// A panic in a masker only leaves its own match unmasked, and the stop
+// reason is StopPanic, so the intercept policy is applied from there.
+func MaskEx(ctx context.Context, b []byte, l Limits) ([]byte, MaskResult) {
+	return internal.MaskEx(ctx, b, l)
+}
+
+// MatchKey reports whether a rule key matches the end of the given key,
+// e.g. the key "user.phone" matches the rule key "phone".
+func MatchKey(key string) bool {
+	return internal.RuleOfKey(key) != nil
+}
+
+// MaskValue masks the value in-place with the rule whose key matches the end
+// of the given key, as if the value follows the key, e.g. the key "user.phone"
+// matches the rule key "phone". It reports whether such a rule exists, and
+// whether the value is changed. If the masker panics, the value is redacted.
+func MaskValue(key string, value []byte) (matched bool, changed bool) {
+	return internal.MaskValue(key, value)
+}
+
+// Finding describes a piece of sensitive data found by Scan. The spans
+// are half-open, that is, the key is b[KeyStart:KeyEnd].
+type Finding = internal.Finding
+
+// Scan finds the sensitive data in the byte slice without modifying it.
+// The value span of each finding covers the bytes that the masker would
+// change, which is computed by running the masker on a scratch copy.
+func Scan(b []byte) []Finding {
+	return internal.Scan(b)
+}
+
+// ScanFunc is like Scan, but it calls yield for each finding in order,
+// and stops when yield returns false. The findings are yielded while the
+// input is matched, once a key is matched after their windows, so large
+// inputs are scanned without collecting all the matches first. The maskers
+// are applied on a copy of the windows in the same order as Mask, so the
+// value spans match what Mask changes under every overlap policy. It
+// returns StopPanic if the matching or a masker panicked, the whole window
+// of a panicking masker is reported as its value span.
+func ScanFunc(b []byte, yield func(Finding) bool) StopReason {
+	return internal.ScanFunc(b, yield)
+}
+
+// Observer observes the masking operations. Its methods are called
+// synchronously by the masking functions, so they should be fast and
+// safe for concurrent use.
+type Observer = internal.Observer
+
+// SetObserver sets the observer of the masking operations, nil disables
+// observing, which is the default.
+func SetObserver(o Observer) {
+	internal.SetObserver(o)
+}
+
+// Counters is an Observer that counts the rule hits, the interceptions,
+// the panics and the latency of the masking operations lock-free.
+type Counters = internal.Counters
+
+// CountersSnapshot is a snapshot of the Counters.
+type CountersSnapshot = internal.CountersSnapshot
+
+// RuleCounts is the counts of the events of a rule.
+type RuleCounts = internal.RuleCounts
+
+// Histogram is a snapshot of the latency histogram.
+type Histogram = internal.Histogram
+
+// NewCounters returns an empty Counters, which can be published via
+// expvar by its Publish method.
+func NewCounters() *Counters {
+	return internal.NewCounters()
+}
+
+// Explanation describes a key candidate found by the trie walk, and why it
+// was or was not masked.
+type Explanation = internal.Explanation
+
+// Explain traces the trie walk over the byte slice without modifying it,
+// and explains each key candidate: the filter verdict with its reason, the
+// window handed to the masker, and the bytes before and after masking.
+// It helps to find out why a line was or was not masked.
+func Explain(b []byte) []Explanation {
+	return internal.Explain(b)
+}
+
+// InterceptPolicy defines how the unscanned remainder is handled when
+// a masking operation is interrupted.
+type InterceptPolicy = internal.InterceptPolicy
+
+const (
+	InterceptKeep     = internal.InterceptKeep     // leaves the remainder as is
+	InterceptRedact   = internal.InterceptRedact   // redacts the remainder with '*'
+	InterceptReplace  = internal.InterceptReplace  // replaces the whole slice with the placeholder
+	InterceptTruncate = internal.InterceptTruncate // truncates the slice at the scan position
+)
+
+// SetInterceptPolicy sets how the unscanned remainder is handled when
+// a masking operation is interrupted. The default policy InterceptRedact
+// redacts the remainder, InterceptKeep leaves it as is, which may still
+// contain sensitive data.
+// Callers must use the returned slice of the masking functions, because
+// InterceptReplace and InterceptTruncate change its length.
+func SetInterceptPolicy(p InterceptPolicy) {
+	internal.SetInterceptPolicy(p)
+}
+
+// SetInterceptPlaceholder sets the placeholder used by InterceptReplace.
+func SetInterceptPlaceholder(s string) {
+	internal.SetInterceptPlaceholder(s)
+}
+
+// OverlapPolicy defines how the masking windows of the close matches are
+// resolved. The window of a match starts right after its key, and spans
+// at most Rule.Length bytes, so it may cover the following keys.
+type OverlapPolicy = internal.OverlapPolicy
+
+const (
+	OverlapAllow = internal.OverlapAllow // windows may overlap the following keys and windows
+	OverlapClip  = internal.OverlapClip  // each window is clipped at the start of the next key
+	OverlapMerge = internal.OverlapMerge // overlapping windows of the same rule are merged, others are clipped
+)
+
+// SetOverlapPolicy sets how the masking windows of the close matches are
+// resolved. The default policy OverlapAllow lets a masker see the following
+// fields, so it may mask a value of another field. OverlapClip confines
+// each masker to its own field. OverlapMerge merges the windows of the
+// adjacent fields of the same rule, and applies all their maskers to the
+// merged window from the front to the back, so a field holding several
+// values is fully masked, while the windows of different rules are clipped.
+func SetOverlapPolicy(p OverlapPolicy) {
+	internal.SetOverlapPolicy(p)
+}
+
+// Clock provides the current time for measuring the masking budget.
+type Clock = internal.Clock
+
+// CoarseClock caches the current timestamp and updates it periodically
+// in a background goroutine, which is started lazily and can be stopped.
+type CoarseClock = internal.CoarseClock
+
+// SystemClock reads the monotonic clock directly.
+type SystemClock = internal.SystemClock
+
+// FakeClock is a clock for deterministic tests.
+type FakeClock = internal.FakeClock
+
+// NewCoarseClock returns a clock that updates its cached timestamp
+// every interval.
+func NewCoarseClock(interval time.Duration) *CoarseClock {
+	return internal.NewCoarseClock(interval)
+}
+
+// NewFakeClock returns a fake clock starting at start, which moves forward
+// step microseconds every time it is read.
+func NewFakeClock(start int64, step int64) *FakeClock {
+	return internal.NewFakeClock(start, step)
+}
+
+// SetClock sets the clock used to measure the masking budget. By default,
+// a coarse clock that is updated every one millisecond is used.
+func SetClock(c Clock) {
+	internal.SetClock(c)
+}
+
+// StopClock stops the background goroutine of the current clock, if any.
+// A stopped coarse clock is started again when it is used next time.
+func StopClock() {
+	internal.StopClock()
+}
+
+// SetPreciseClock sets whether the time budget is measured with the
+// monotonic clock. By default, a cached timestamp that is updated every
+// one millisecond is used, so budgets below one millisecond are imprecise.
+func SetPreciseClock(precise bool) {
+	if precise {
+		internal.SetClock(SystemClock{})
+	} else {
+		internal.SetClock(internal.DefaultClock)
+	}
+}
+
 // KeyFilter defines a function type that checks whether a matched key is valid.
 type KeyFilter = internal.KeyFilter
 
-// SetKeyFilter sets the key filter.
+// SetKeyFilter sets the key filter, nil restores the default one, which
+// requires a splitter on both sides of a key.
 func SetKeyFilter(f KeyFilter) {
 	internal.SetKeyFilter(f)
 }
 
+// SetExtraKeyChars sets the extra ASCII punctuation characters allowed in
+// keys besides letters, digits, '-', '_' and '@', e.g. ".[]$" for keys like
+// "user.phone", "headers[x-token]" and "$.card". '*' is not allowed, it's
+// the wildcard. The extra characters are still splitters, so "phone" also
+// matches in "user.phone:...", even when a key like "user.phone" exists but
+// doesn't match there. Call it before LoadTrie if the trie is built with
+// extra characters.
+func SetExtraKeyChars(chars string) error {
+	return internal.SetExtraKeyChars(chars)
+}
+
 // DumpTrie outputs all keys reverse-parsed from the prefix tree.
-// It returns a sorted list of all keys presented in the trie.
+// It returns a sorted list of all keys presented in the trie. The keys
+// of case-sensitive rules are in their exact case, others in lower case.
 func DumpTrie() []string {
 	return internal.DumpTrie()
 }
+
+// DumpTrieRules is like DumpTrie, but it returns the name of the rule that
+// wins each key. When rules claim the same key, the rule with the higher
+// Priority wins, then the rule with the smaller name.
+func DumpTrieRules() map[string]string {
+	return internal.DumpTrieRules()
+}
+
+// DumpDOT renders the prefix tree in the Graphviz DOT language, e.g. for
+// `dot -Tpng`. Terminal nodes are double circles labeled with their flags
+// and rule, and the pointers to the last terminal nodes are dashed edges.
+// If prefix is not empty, only the subtree under it is rendered.
+func DumpDOT(prefix string) string {
+	return internal.DumpDOT(prefix)
+}
+
+// SectionStats describes the children in a section of the trie nodes.
+type SectionStats = internal.SectionStats
+
+// TrieStats describes the shape and the memory footprint of the trie.
+type TrieStats = internal.TrieStats
+
+// Stats returns the statistics of the trie, such as the numbers of nodes
+// and keys, the depths, the distribution of the children by section, the
+// estimated memory footprint, and the keys collapsed into other variants,
+// e.g. "abc" is collapsed when "*abc*" exists.
+func Stats() TrieStats {
+	return internal.Stats()
+}
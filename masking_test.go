@@ -16,18 +16,21 @@ package masking_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"expvar"
+	"fmt"
 	"math"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/lvan100/go-masking"
-	"github.com/lvan100/go-masking/internal"
 )
 
 var ruleMerged atomic.Bool
@@ -114,6 +117,27 @@ func testMergeRules(t testing.TB) {
 	}
 }
 
+// restoreRules restores the rules merged by testMergeRules when the test
+// and all its subtests complete, so the rules merged by the test don't
+// leak into the later tests. The rules left by the earlier tests are
+// restored with the phone masker.
+func restoreRules(t testing.TB) {
+	data, err := masking.MarshalTrie()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	maskers := make(map[string]masking.Masker)
+	for _, name := range masking.RuleNames() {
+		maskers[name] = masking.SimplePhoneMasker
+	}
+	t.Cleanup(func() {
+		err := masking.LoadTrie(data, maskers)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
 var casesOfMask = []struct {
 	src  string
 	want string
@@ -190,9 +214,7 @@ func TestMask(t *testing.T) {
 	}
 
 	{
-		internal.MatchSleep = func() {
-			time.Sleep(10 * time.Millisecond)
-		}
+		masking.SetClock(masking.NewFakeClock(0, 10000))
 		s := make([]byte, 256)
 		for i := 0; i < len(s); i++ {
 			s[i] = byte(int('0') + i%10)
@@ -201,10 +223,10 @@ func TestMask(t *testing.T) {
 		if !intercepted {
 			t.Fatalf("expect intercepted, got not")
 		}
-		internal.MatchSleep = nil
+		masking.SetPreciseClock(false)
 	}
 
-	masking.SetKeyFilter(internal.DefaultKeyFilter)
+	masking.SetKeyFilter(nil)
 	for _, tt := range casesOfMask {
 		s := []byte(strings.Clone(tt.src))
 		masking.Mask(s, 2000)
@@ -214,6 +236,1004 @@ func TestMask(t *testing.T) {
 	}
 }
 
+func TestMaskContext(t *testing.T) {
+	testMergeRules(t)
+	// the remainder is kept, so the scan position can be checked.
+	masking.SetInterceptPolicy(masking.InterceptKeep)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s := []byte("cell:12345678900")
+		_, reason := masking.MaskContext(ctx, s)
+		if reason != masking.StopCanceled {
+			t.Fatalf("got %v, expect %v", reason, masking.StopCanceled)
+		}
+		if string(s) != "cell:12345678900" {
+			t.Fatalf("got %s, expect unchanged", s)
+		}
+	}
+
+	{
+		masking.SetClock(masking.NewFakeClock(0, 1000))
+		defer masking.SetPreciseClock(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Microsecond)
+		defer cancel()
+		s := make([]byte, 256)
+		for i := 0; i < len(s); i++ {
+			s[i] = byte(int('0') + i%10)
+		}
+		_, reason := masking.MaskContext(ctx, s)
+		if reason != masking.StopDeadline {
+			t.Fatalf("got %v, expect %v", reason, masking.StopDeadline)
+		}
+	}
+
+	for _, tt := range casesOfMask {
+		s := []byte(strings.Clone(tt.src))
+		_, reason := masking.MaskContext(context.Background(), s)
+		if reason != masking.StopNone {
+			t.Errorf("MaskContext() stopped by %v", reason)
+		}
+		if bytes.Compare(s, []byte(tt.want)) != 0 {
+			t.Errorf("MaskContext() = %s, want %s", s, tt.want)
+		}
+	}
+}
+
+func TestMaskLimits(t *testing.T) {
+	testMergeRules(t)
+	// the remainder is kept, so the scan position can be checked.
+	masking.SetInterceptPolicy(masking.InterceptKeep)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	const src = "cell:12345678900, phone:12345678900, mobile:12345678900"
+
+	testCases := []struct {
+		limits masking.Limits
+		want   string
+		reason masking.StopReason
+	}{
+		{
+			limits: masking.Limits{},
+			want:   "cell:123****8900, phone:123****8900, mobile:123****8900",
+			reason: masking.StopNone,
+		},
+		{
+			limits: masking.Limits{MaxBytes: 30},
+			want:   "cell:123****8900, phone:123****8900, mobile:12345678900",
+			reason: masking.StopByteLimit,
+		},
+		{
+			limits: masking.Limits{MaxMatches: 1},
+			want:   "cell:123****8900, phone:12345678900, mobile:12345678900",
+			reason: masking.StopMatchLimit,
+		},
+		{
+			limits: masking.Limits{MaxMatches: 3},
+			want:   "cell:123****8900, phone:123****8900, mobile:123****8900",
+			reason: masking.StopNone,
+		},
+		{
+			limits: masking.Limits{MaxBytes: 30, MaxMatches: 1},
+			want:   "cell:123****8900, phone:12345678900, mobile:12345678900",
+			reason: masking.StopMatchLimit,
+		},
+	}
+
+	for i, tt := range testCases {
+		s := []byte(src)
+		_, reason := masking.MaskLimits(context.Background(), s, tt.limits)
+		if reason != tt.reason {
+			t.Errorf("%d: got reason %v, expect %v", i, reason, tt.reason)
+		}
+		if string(s) != tt.want {
+			t.Errorf("%d: MaskLimits() = %s, want %s", i, s, tt.want)
+		}
+	}
+
+	{
+		masking.SetClock(masking.NewFakeClock(0, 1000))
+		s := []byte(strings.Repeat("0123456789", 26) + src)
+		_, reason := masking.MaskLimits(context.Background(), s, masking.Limits{
+			MaxTime:  1500,
+			MaxBytes: 100,
+		})
+		if reason != masking.StopByteLimit {
+			t.Errorf("got reason %v, expect %v", reason, masking.StopByteLimit)
+		}
+		_, reason = masking.MaskLimits(context.Background(), s, masking.Limits{
+			MaxTime:  1500,
+			MaxBytes: 200,
+		})
+		if reason != masking.StopDeadline {
+			t.Errorf("got reason %v, expect %v", reason, masking.StopDeadline)
+		}
+		masking.SetPreciseClock(false)
+	}
+}
+
+func TestInterceptPolicy(t *testing.T) {
+	testMergeRules(t)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	const src = "cell:12345678900, phone:12345678900\n"
+
+	// the remainder is redacted by default.
+	b, _ := masking.MaskLimits(context.Background(), []byte(src), masking.Limits{MaxBytes: 19})
+	if want := "cell:123****8900, p" + strings.Repeat("*", 16) + "\n"; string(b) != want {
+		t.Errorf("MaskLimits() = %q, want %q", b, want)
+	}
+
+	testCases := []struct {
+		policy masking.InterceptPolicy
+		want   string
+	}{
+		{
+			policy: masking.InterceptKeep,
+			want:   "cell:123****8900, phone:12345678900\n",
+		},
+		{
+			policy: masking.InterceptRedact,
+			want:   "cell:123****8900, p" + strings.Repeat("*", 16) + "\n",
+		},
+		{
+			policy: masking.InterceptReplace,
+			want:   "<masked>",
+		},
+		{
+			policy: masking.InterceptTruncate,
+			want:   "cell:123****8900, p",
+		},
+	}
+
+	masking.SetInterceptPlaceholder("<masked>")
+	defer masking.SetInterceptPlaceholder("[MASKING INTERCEPTED]")
+
+	for _, tt := range testCases {
+		masking.SetInterceptPolicy(tt.policy)
+		b, reason := masking.MaskLimits(context.Background(), []byte(src), masking.Limits{MaxBytes: 19})
+		if reason != masking.StopByteLimit {
+			t.Errorf("%v: got reason %v, expect %v", tt.policy, reason, masking.StopByteLimit)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%v: MaskLimits() = %q, want %q", tt.policy, b, tt.want)
+		}
+	}
+
+	{
+		// the placeholder doesn't overwrite the bytes after the slice.
+		masking.SetInterceptPolicy(masking.InterceptReplace)
+		masking.SetInterceptPlaceholder(strings.Repeat("#", 64))
+		buf := []byte(src + "cell:12345678900\n")
+		b, _ := masking.MaskLimits(context.Background(), buf[:len(src)], masking.Limits{MaxBytes: 19})
+		if string(b) != strings.Repeat("#", 64) || string(buf[len(src):]) != "cell:12345678900\n" {
+			t.Errorf("MaskLimits() = %q, buffer %q", b, buf)
+		}
+		masking.SetInterceptPlaceholder("<masked>")
+	}
+
+	{
+		masking.SetInterceptPolicy(masking.InterceptRedact)
+		masking.SetClock(masking.NewFakeClock(0, 1500))
+		prefix := strings.Repeat("0123456789", 26)
+		b, intercepted := masking.Mask([]byte(prefix+src), 2000)
+		if !intercepted {
+			t.Fatalf("expect intercepted, got not")
+		}
+		want := prefix[:128] + strings.Repeat("*", len(prefix)+len(src)-129) + "\n"
+		if string(b) != want {
+			t.Errorf("Mask() = %q, want %q", b, want)
+		}
+		masking.SetPreciseClock(false)
+	}
+}
+
+func TestMaskBudgetSpansMaskers(t *testing.T) {
+	testMergeRules(t)
+	defer masking.SetPreciseClock(false)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	const src = "cell:12345678900, phone:12345678900, mobile:12345678900"
+
+	// the fake clock moves 1000us every time it is read, so the budget
+	// is exhausted after the masker of the last match is invoked.
+	testCases := []struct {
+		policy masking.InterceptPolicy
+		want   string
+	}{
+		{
+			policy: masking.InterceptKeep,
+			want:   "cell:12345678900, phone:12345678900, mobile:123****8900",
+		},
+		{
+			policy: masking.InterceptRedact,
+			want:   "cell" + strings.Repeat("*", len(src)-4),
+		},
+		{
+			policy: masking.InterceptTruncate,
+			want:   "cell",
+		},
+	}
+
+	for _, tt := range testCases {
+		masking.SetInterceptPolicy(tt.policy)
+		masking.SetClock(masking.NewFakeClock(0, 1000))
+		b, reason := masking.MaskLimits(context.Background(), []byte(src), masking.Limits{MaxTime: 2500})
+		if reason != masking.StopDeadline {
+			t.Errorf("%v: got reason %v, expect %v", tt.policy, reason, masking.StopDeadline)
+		}
+		if string(b) != tt.want {
+			t.Errorf("%v: MaskLimits() = %q, want %q", tt.policy, b, tt.want)
+		}
+	}
+}
+
+func TestMaskEx(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+	// the remainder is kept, so the scan position can be checked.
+	masking.SetInterceptPolicy(masking.InterceptKeep)
+	defer masking.SetInterceptPolicy(masking.InterceptRedact)
+
+	{
+		b, r := masking.MaskEx(context.Background(), []byte("cell:12345678900, phone:12345678900"), masking.Limits{})
+		if string(b) != "cell:123****8900, phone:123****8900" {
+			t.Errorf("MaskEx() = %s", b)
+		}
+		if r.Reason != masking.StopNone || r.Found != 2 || r.Masked != 2 || r.Unmasked() != 0 || len(r.Panics) != 0 {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+
+	{
+		masking.SetKeyFilter(func(b []byte, start int, end int, anyStart bool, anyEnd bool) bool {
+			panic("filter")
+		})
+		_, r := masking.MaskEx(context.Background(), []byte("cell:12345678900"), masking.Limits{})
+		masking.SetKeyFilter(nil)
+		if r.Reason != masking.StopPanic || len(r.Panics) != 1 {
+			t.Fatalf("unexpected result %+v", r)
+		}
+		if p := r.Panics[0]; p.Rule != "" || p.Value != "filter" || len(p.Stack) == 0 {
+			t.Errorf("unexpected panic %+v", p)
+		}
+	}
+
+	{
+		err := masking.MergeRules(map[string]*masking.Rule{
+			"broken": {
+				Keys:   []string{"broken_key"},
+				Length: 30,
+				Masker: func(b []byte) { panic("broken") },
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		src := "cell:12345678900, broken_key:12345678900, phone:12345678900"
+		b, r := masking.MaskEx(context.Background(), []byte(src), masking.Limits{})
+		if string(b) != "cell:123****8900, broken_key:12345678900, phone:123****8900" {
+			t.Errorf("MaskEx() = %s", b)
+		}
+		if r.Reason != masking.StopPanic || r.Found != 3 || r.Masked != 2 || r.Unmasked() != 1 {
+			t.Errorf("unexpected result %+v", r)
+		}
+		if len(r.Panics) != 1 || r.Panics[0].Rule != "broken" || r.Panics[0].Value != "broken" {
+			t.Errorf("unexpected panics %+v", r.Panics)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+
+	const src = "cell:12345678900, x_suffix_p=abc, phone:+8612345678901"
+	b := []byte(src)
+	got := masking.Scan(b)
+	if string(b) != src {
+		t.Fatalf("Scan() modified the input: %s", b)
+	}
+	want := []masking.Finding{
+		{KeyStart: 0, KeyEnd: 4, ValueStart: 8, ValueEnd: 12, Rule: "phone", Desc: "手机号"},
+		// the window covers the value of phone, which is masked first.
+		{KeyStart: 19, KeyEnd: 28, ValueStart: 28, ValueEnd: 28, Rule: "phone", Desc: "手机号"},
+		{KeyStart: 34, KeyEnd: 39, ValueStart: 46, ValueEnd: 50, Rule: "phone", Desc: "手机号"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Scan() = %+v, want %+v", got, want)
+	}
+	if s := src[got[2].KeyStart:got[2].KeyEnd]; s != "phone" {
+		t.Errorf("got key %s, expect phone", s)
+	}
+
+	if f := masking.Scan([]byte("cell:abc, ")); len(f) != 1 || f[0].ValueStart != 4 || f[0].ValueEnd != 4 {
+		t.Errorf("Scan() = %+v, expect an empty value span", f)
+	}
+
+	var n int
+	reason := masking.ScanFunc(b, func(f masking.Finding) bool {
+		if f != want[n] {
+			t.Errorf("ScanFunc() = %+v, want %+v", f, want[n])
+		}
+		n++
+		return n < 2
+	})
+	if n != 2 || reason != masking.StopNone {
+		t.Errorf("ScanFunc() yields %d findings and %s, expect 2 and none", n, reason)
+	}
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"broken": {
+			Keys:   []string{"broken_key"},
+			Length: 5,
+			Masker: func(b []byte) { panic("broken") },
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got2 []masking.Finding
+	reason = masking.ScanFunc([]byte("broken_key:12345678900, cell:12345678900"), func(f masking.Finding) bool {
+		got2 = append(got2, f)
+		return true
+	})
+	if reason != masking.StopPanic || len(got2) != 2 || got2[0].ValueStart != 10 || got2[0].ValueEnd != 15 {
+		t.Errorf("ScanFunc() = %+v and %s, expect the broken window and panic", got2, reason)
+	}
+
+	// the findings are yielded once the next key is matched after their
+	// windows, before the rest is matched.
+	masking.SetKeyFilter(func(b []byte, start, end int, anyStart, anyEnd bool) bool {
+		if start > 80 {
+			panic("filter")
+		}
+		return true
+	})
+	defer masking.SetKeyFilter(nil)
+	got2 = got2[:0]
+	src2 := "cell:12345678900" + strings.Repeat(" ", 40) + "phone:12345678900" + strings.Repeat(" ", 40) + "mobile:12345678900"
+	reason = masking.ScanFunc([]byte(src2), func(f masking.Finding) bool {
+		got2 = append(got2, f)
+		return true
+	})
+	if reason != masking.StopPanic || len(got2) != 1 || got2[0].KeyStart != 0 {
+		t.Errorf("ScanFunc() = %+v and %s, expect cell yielded before the panic", got2, reason)
+	}
+}
+
+func TestScanOverlap(t *testing.T) {
+	testMergeRules(t)
+	defer masking.SetOverlapPolicy(masking.OverlapAllow)
+
+	srcs := []string{
+		`{"cell":"12345678900,12345678901","phone":""}`,
+		`{"cell":"","id_no":"110101199003074578","phone":"12345678901","mobile":"12345678902"}`,
+		"cell:12345678900, x_suffix_p=abc, phone:+8612345678901",
+	}
+	for _, policy := range []masking.OverlapPolicy{masking.OverlapAllow, masking.OverlapClip, masking.OverlapMerge} {
+		masking.SetOverlapPolicy(policy)
+		for _, src := range srcs {
+			// the bytes changed by Mask are exactly the value spans of Scan.
+			masked, _ := masking.Mask([]byte(src), math.MaxInt)
+			changed := make([]bool, len(src))
+			for _, f := range masking.Scan([]byte(src)) {
+				for i := f.ValueStart; i < f.ValueEnd; i++ {
+					changed[i] = true
+				}
+			}
+			for i := range src {
+				if (src[i] != masked[i]) != changed[i] {
+					t.Errorf("%s: %s: Scan() disagrees with Mask() at offset %d", policy, src, i)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	testMergeRules(t)
+
+	c := masking.NewCounters()
+	masking.SetObserver(c)
+	defer masking.SetObserver(nil)
+
+	masking.Mask([]byte("cell:12345678900, phone:123"), 2000)
+	masking.Mask([]byte("cell:12345678900"), 2000)
+	masking.MaskLimits(context.Background(), []byte("cell:1, phone:2"), masking.Limits{MaxMatches: 1})
+
+	s := c.Snapshot()
+	if got, want := s.Rules["phone"], (masking.RuleCounts{Hits: 4, Changed: 2, Unchanged: 2}); got != want {
+		t.Errorf("got %+v, expect %+v", got, want)
+	}
+	if got := s.Intercepted["match-limit"]; got != 1 {
+		t.Errorf("got %d match-limit interceptions, expect 1", got)
+	}
+	if s.Latency.Count != 3 || len(s.Latency.Counts) != len(s.Latency.Bounds)+1 {
+		t.Errorf("unexpected latency %+v", s.Latency)
+	}
+	var n int64
+	for _, v := range s.Latency.Counts {
+		n += v
+	}
+	if n != 3 {
+		t.Errorf("got %d observations in buckets, expect 3", n)
+	}
+
+	c.Publish("masking_test_counters")
+	v := expvar.Get("masking_test_counters")
+	if v == nil || !strings.Contains(v.String(), `"Hits":4`) {
+		t.Errorf("unexpected expvar %v", v)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testMergeRules(t)
+
+	src := []byte("xcell:12345678900, cell1:123, phone:12345678900, 123_suffix_p:xyz cell")
+	got := masking.Explain(src)
+	if string(src) != "xcell:12345678900, cell1:123, phone:12345678900, 123_suffix_p:xyz cell" {
+		t.Fatalf("Explain() modified the input: %s", src)
+	}
+	want := []string{
+		`key "cell" at [1,5) rule phone: rejected, no start splitter at offset 0 ('x')`,
+		`key "cell" at [19,23) rule phone: rejected, no end splitter at offset 23 ('1')`,
+		`key "phone" at [30,35) rule phone: matched, both start and end splitters found; window [35,65) ":12345678900, 123_suffix_p:xyz" -> ":123****8900, 123_suffix_p:xyz"`,
+		`key "_suffix_p" at [52,61) rule phone: matched, wildcard key *_suffix_p matched; window [61,70) ":xyz cell" unchanged by the masker`,
+		`key "cell" at [66,70): rejected, the walk reached the end of input, a key must be followed by a splitter`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Explain() = %v, want %d explanations", got, len(want))
+	}
+	for i, e := range got {
+		if e.String() != want[i] {
+			t.Errorf("got %s, expect %s", e.String(), want[i])
+		}
+	}
+
+	masking.SetKeyFilter(func(b []byte, start int, end int, anyStart bool, anyEnd bool) bool {
+		return true
+	})
+	got = masking.Explain(src)
+	if len(got) == 0 || !got[0].Matched || got[0].Reason != "accepted by the custom key filter" {
+		t.Errorf("Explain() = %v, expect the first key accepted by the custom key filter", got)
+	}
+	masking.SetKeyFilter(nil)
+	if got = masking.Explain(src); len(got) == 0 || got[0].String() != want[0] {
+		t.Errorf("Explain() = %v, expect the default key filter restored", got)
+	}
+}
+
+func TestOverlapPolicy(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+	defer masking.SetOverlapPolicy(masking.OverlapAllow)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"id": {
+			Desc:   "身份证号",
+			Keys:   []string{"id_no"},
+			Length: 30,
+			Masker: masking.SimpleIdMasker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srcs := []string{
+		`{"cell":"","order_no":"12345678901234"}`,
+		`{"cell":"","id_no":"12345678901"}`,
+		`{"cell":"12345678900,12345678901","phone":""}`,
+		`{"cell":"","id_no":"110101199003074578","phone":"12345678901","mobile":"12345678902"}`,
+	}
+	testCases := []struct {
+		policy masking.OverlapPolicy
+		want   []string
+	}{
+		{
+			policy: masking.OverlapAllow,
+			want: []string{
+				`{"cell":"","order_no":"123****8901234"}`,
+				`{"cell":"","id_no":"123****8901"}`,
+				`{"cell":"123****8900,12345678901","phone":""}`,
+				`{"cell":"","id_no":"110101********4578","phone":"123****8901","mobile":"123****8902"}`,
+			},
+		},
+		{
+			policy: masking.OverlapClip,
+			want: []string{
+				`{"cell":"","order_no":"123****8901234"}`,
+				`{"cell":"","id_no":"12345678901"}`,
+				`{"cell":"123****8900,12345678901","phone":""}`,
+				`{"cell":"","id_no":"110101********4578","phone":"123****8901","mobile":"123****8902"}`,
+			},
+		},
+		{
+			policy: masking.OverlapMerge,
+			want: []string{
+				`{"cell":"","order_no":"123****8901234"}`,
+				`{"cell":"","id_no":"12345678901"}`,
+				`{"cell":"123****8900,123****8901","phone":""}`,
+				`{"cell":"","id_no":"110101********4578","phone":"123****8901","mobile":"123****8902"}`,
+			},
+		},
+	}
+	for _, c := range testCases {
+		masking.SetOverlapPolicy(c.policy)
+		for i, src := range srcs {
+			got, intercepted := masking.Mask([]byte(src), math.MaxInt)
+			if intercepted {
+				t.Fatalf("%s: Mask(%s) intercepted", c.policy, src)
+			}
+			if string(got) != c.want[i] {
+				t.Errorf("%s: got %s, expect %s", c.policy, got, c.want[i])
+			}
+		}
+	}
+}
+
+func TestLoadTrie(t *testing.T) {
+	testMergeRules(t)
+
+	data, err := masking.MarshalTrie()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := masking.DumpTrie()
+
+	err = masking.LoadTrie(data, map[string]masking.Masker{})
+	if err == nil || !strings.HasPrefix(err.Error(), "no masker for rule") {
+		t.Fatalf("got error %v, expect no masker for rule", err)
+	}
+	data[len(data)/2]++
+	err = masking.LoadTrie(data, nil)
+	if !errors.Is(err, masking.ErrInvalidTrie) {
+		t.Fatalf("got error %v, expect %v", err, masking.ErrInvalidTrie)
+	}
+	if got := masking.DumpTrie(); slices.Compare(got, keys) != 0 {
+		t.Fatalf("got %v, expect %v", got, keys)
+	}
+}
+
+func TestDumpDOT(t *testing.T) {
+	testMergeRules(t)
+
+	got := masking.DumpDOT("driver_")
+	for _, s := range []string{
+		"digraph trie {\n",
+		`[label="r"];`,
+		`rule phone", shape=doublecircle];`,
+	} {
+		if !strings.Contains(got, s) {
+			t.Errorf("DumpDOT() = %s, want containing %s", got, s)
+		}
+	}
+	if strings.Contains(got, "mobile") || strings.Count(got, "doublecircle") != 1 {
+		t.Errorf("DumpDOT() = %s, want only driver_phone", got)
+	}
+}
+
+func TestMergeWhileMasking(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+
+	const src = "cell:12345678900, phone:12345678900, temp_0:12345678900"
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				b, intercepted := masking.Mask([]byte(src), math.MaxInt)
+				if intercepted || !strings.HasPrefix(string(b), "cell:123****8900, phone:123****8900") {
+					t.Errorf("got %s", b)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("temp_%d", i%10)
+		err := masking.MergeRules(map[string]*masking.Rule{
+			"temp": {Keys: []string{key}, Length: 30 + i%2, Masker: masking.SimplePhoneMasker, Priority: i % 3},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err = masking.RemoveKeys("temp", key); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err = masking.SetExtraKeyChars([]string{".", ""}[i%2]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRemoveKeys(t *testing.T) {
+	testMergeRules(t)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"temp": {
+			Keys:   []string{"Temp_Phone", "cell"},
+			Length: 30,
+			Masker: masking.SimplePhoneMasker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := masking.Mask([]byte("temp_phone:12345678900"), math.MaxInt)
+	if string(b) != "temp_phone:123****8900" {
+		t.Fatalf("got %s", b)
+	}
+
+	if err = masking.RemoveKeys("temp", "TEMP_PHONE", "cell"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := masking.DumpTrie()
+	if slices.Contains(keys, "temp_phone") || !slices.Contains(keys, "cell") {
+		t.Fatalf("got %v", keys)
+	}
+	b, _ = masking.Mask([]byte("temp_phone:12345678900, cell:12345678900"), math.MaxInt)
+	if string(b) != "temp_phone:12345678900, cell:123****8900" {
+		t.Fatalf("got %s", b)
+	}
+
+	err = masking.RemoveKeys("not_exist", "cell")
+	if err == nil || err.Error() != "rule 'not_exist' not found" {
+		t.Fatalf("got error %v, expect rule 'not_exist' not found", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	testMergeRules(t)
+
+	s := masking.Stats()
+	if s.Keys < len(masking.DumpTrie()) || s.TerminalNodes != len(masking.DumpTrie()) {
+		t.Fatalf("got %+v, expect %d terminal nodes", s, len(masking.DumpTrie()))
+	}
+	if s.Nodes <= s.TerminalNodes || s.MaxDepth < int(s.AvgDepth) || s.Bytes <= 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.WildcardNodes == 0 || s.CollapsedKeys == 0 {
+		t.Fatalf("got %+v, expect wildcard and collapsed keys", s)
+	}
+}
+
+func TestMergeRulesReport(t *testing.T) {
+	testMergeRules(t)
+
+	keys := masking.DumpTrie()
+	report, err := masking.MergeRulesReport(map[string]*masking.Rule{
+		"strict": {Keys: []string{"cell", "_suffix_p"}, Masker: masking.SimplePhoneMasker},
+	}, masking.MergeOptions{Strict: true})
+	if !errors.Is(err, masking.ErrMergeDiagnostics) {
+		t.Fatalf("got error %v, expect %v", err, masking.ErrMergeDiagnostics)
+	}
+	want := `key "_suffix_p" of rule phone is subsumed by "*_suffix_p" of rule phone
+key "_suffix_p" is claimed by rules phone, strict, rule phone wins
+key "cell" is claimed by rules phone, strict, rule phone wins`
+	if report.String() != want {
+		t.Fatalf("got %s, expect %s", report, want)
+	}
+	if slices.Contains(masking.RuleNames(), "strict") || slices.Compare(masking.DumpTrie(), keys) != 0 {
+		t.Fatal("expect the rules unchanged in strict mode")
+	}
+}
+
+func TestRulePriority(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+
+	vipMasker := func(b []byte) {
+		for i, c := range b {
+			if c >= '0' && c <= '9' {
+				b[i] = 'x'
+			}
+		}
+	}
+
+	report, err := masking.MergeRulesReport(map[string]*masking.Rule{
+		"a_plain": {Keys: []string{"driver_vip_phone", "vip_cell"}, Length: 30, Masker: masking.SimplePhoneMasker},
+		"z_vip":   {Keys: []string{"*_vip_phone", "vip_cell"}, Length: 30, Masker: vipMasker, Priority: 1},
+	}, masking.MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the key of the plain rule is shadowed by the wildcard key of z_vip.
+	want := `key "vip_cell" is claimed by rules z_vip, a_plain, rule z_vip wins
+key "driver_vip_phone" of rule a_plain never matches, the key filter rejects it or other keys take precedence`
+	if report.String() != want {
+		t.Fatalf("got %s, expect %s", report, want)
+	}
+	rules := masking.DumpTrieRules()
+	if rules["vip_cell"] != "z_vip" || rules["*_vip_phone"] != "z_vip" || rules["driver_vip_phone"] != "a_plain" {
+		t.Fatalf("got %v", rules)
+	}
+	b, _ := masking.Mask([]byte("driver_vip_phone:12345678900"), math.MaxInt)
+	if string(b) != "driver_vip_phone:xxxxxxxxxxx" {
+		t.Fatalf("got %s, expect masked by rule z_vip", b)
+	}
+	e := masking.Explain([]byte("driver_vip_phone:12345678900"))
+	if len(e) != 1 || e[0].Rule != "z_vip" || e[0].Reason != `key "_vip_phone" of rule z_vip takes precedence with priority 1` {
+		t.Fatalf("Explain() = %v, expect rule z_vip taking precedence", e)
+	}
+	if e[0].Key != "_vip_phone" || e[0].KeyStart != 6 || e[0].KeyEnd != 16 {
+		t.Fatalf("Explain() = %v, expect the span of the winning key", e)
+	}
+
+	// raising the priority of an existing rule changes the winners.
+	if err = masking.MergeRules(map[string]*masking.Rule{"a_plain": {Priority: 2}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules = masking.DumpTrieRules(); rules["vip_cell"] != "a_plain" {
+		t.Fatalf("got %v", rules)
+	}
+	b, _ = masking.Mask([]byte("driver_vip_phone:12345678900"), math.MaxInt)
+	if string(b) != "driver_vip_phone:123****8900" {
+		t.Fatalf("got %s, expect masked by rule a_plain", b)
+	}
+
+	// the wildcards of a key don't pass to another variant of higher priority.
+	report, err = masking.MergeRulesReport(map[string]*masking.Rule{
+		"a_plain": {Keys: []string{"vip"}},
+		"z_vip":   {Keys: []string{"*vip*"}},
+	}, masking.MergeOptions{})
+	if err != nil || !report.Empty() {
+		t.Fatalf("got %s, %v, expect no diagnostics", report, err)
+	}
+	if rules = masking.DumpTrieRules(); rules["vip"] != "a_plain" || rules["*vip*"] != "z_vip" {
+		t.Fatalf("got %v", rules)
+	}
+	for src, want := range map[string]string{
+		"xvipx:12345678900": "xvipx:xxxxxxxxxxx",
+		"vip:12345678900":   "vip:123****8900",
+	} {
+		if b, _ = masking.Mask([]byte(src), math.MaxInt); string(b) != want {
+			t.Fatalf("got %s, expect %s", b, want)
+		}
+	}
+
+	// a merge never resets the priority, replacing the rule does.
+	if err = masking.MergeRules(map[string]*masking.Rule{"a_plain": {Priority: 0}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules = masking.DumpTrieRules(); rules["vip_cell"] != "a_plain" {
+		t.Fatalf("got %v, expect the priority kept", rules)
+	}
+	_, err = masking.MergeRulesReport(map[string]*masking.Rule{
+		"a_plain": {Keys: []string{"driver_vip_phone", "vip_cell", "vip"}, Length: 30, Masker: masking.SimplePhoneMasker},
+	}, masking.MergeOptions{Replace: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules = masking.DumpTrieRules(); rules["vip_cell"] != "z_vip" {
+		t.Fatalf("got %v, expect the priority reset", rules)
+	}
+	b, _ = masking.Mask([]byte("driver_vip_phone:12345678900"), math.MaxInt)
+	if string(b) != "driver_vip_phone:xxxxxxxxxxx" {
+		t.Fatalf("got %s, expect masked by rule z_vip", b)
+	}
+}
+
+func TestSetExtraKeyChars(t *testing.T) {
+	testMergeRules(t)
+
+	if err := masking.SetExtraKeyChars("*"); err == nil || err.Error() != `invalid key char '*'` {
+		t.Fatalf("got error %v, expect invalid key char '*'", err)
+	}
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"dotted": {Keys: []string{"user.phone"}, Length: 30, Masker: masking.SimplePhoneMasker},
+	})
+	if err == nil || err.Error() != "invalid key 'user.phone'" {
+		t.Fatalf("got error %v, expect invalid key 'user.phone'", err)
+	}
+
+	if err = masking.SetExtraKeyChars(".[]$"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = masking.MergeRules(map[string]*masking.Rule{
+		"dotted": {
+			Keys:   []string{"user.phone", "headers[x-token]", "$.card"},
+			Length: 30,
+			Masker: masking.SimplePhoneMasker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for src, want := range map[string]string{
+		`{"user.phone":"13812345678","$.card":"13812345678"}`:            `{"user.phone":"138****5678","$.card":"138****5678"}`,
+		`level=info user.phone=13812345678 headers[x-token]=13812345678`: `level=info user.phone=138****5678 headers[x-token]=138****5678`,
+		// a rejected dotted key doesn't hide the key after the dot.
+		`xuser.phone=13812345678`: `xuser.phone=138****5678`,
+		`a.b.phone=13812345678`:   `a.b.phone=138****5678`,
+	} {
+		b, _ := masking.Mask([]byte(src), math.MaxInt)
+		if string(b) != want {
+			t.Fatalf("got %s, expect %s", b, want)
+		}
+	}
+
+	err = masking.SetExtraKeyChars("")
+	if err == nil || err.Error() != "invalid key '$.card' of rule 'dotted'" {
+		t.Fatalf("got error %v, expect invalid key '$.card' of rule 'dotted'", err)
+	}
+	// the failed call leaves the keys and the trie as they were.
+	if b, _ := masking.Mask([]byte("user.phone=13812345678"), math.MaxInt); string(b) != "user.phone=138****5678" {
+		t.Fatalf("got %s", b)
+	}
+	if err = masking.RemoveKeys("dotted", "user.phone", "headers[x-token]", "$.card"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = masking.SetExtraKeyChars(""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestUTF8Keys(t *testing.T) {
+	testMergeRules(t)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"cn_phone": {Keys: []string{"手机号", "联系电话"}, Length: 30, Masker: masking.SimplePhoneMasker},
+		"cn_id":    {Keys: []string{"身份证号"}, Length: 30, Masker: masking.SimpleIdMasker},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for src, want := range map[string]string{
+		`用户登录，手机号：13812345678，身份证号：110101199003074512`: `用户登录，手机号：138****5678，身份证号：110101********4512`,
+		`{"手机号":"13812345678","phone":"13812345678"}`:  `{"手机号":"138****5678","phone":"138****5678"}`,
+		`订单联系电话=13812345678 用户手机号=13812345678`:         `订单联系电话=13812345678 用户手机号=13812345678`,
+	} {
+		b, _ := masking.Mask([]byte(src), math.MaxInt)
+		if string(b) != want {
+			t.Fatalf("got %s, expect %s", b, want)
+		}
+	}
+
+	e := masking.Explain([]byte("用户手机号：13812345678"))
+	if len(e) == 0 || e[len(e)-1].Matched || e[len(e)-1].Reason != "no start splitter at offset 3 ('户')" {
+		t.Fatalf("got %v", e)
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	testMergeRules(t)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"cs_upper": {Keys: []string{"UserID"}, Length: 30, Masker: masking.SimplePhoneMasker, CaseSensitive: true},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keys := masking.DumpTrie()
+	if !slices.Contains(keys, "UserID") || slices.Contains(keys, "userid") {
+		t.Fatalf("got %v", keys)
+	}
+	src := "UserID:13812345678, userid:13812345678"
+	b, _ := masking.Mask([]byte(src), math.MaxInt)
+	if string(b) != "UserID:138****5678, userid:13812345678" {
+		t.Fatalf("got %s", b)
+	}
+
+	report, err := masking.MergeRulesReport(map[string]*masking.Rule{
+		"cs_lower": {Keys: []string{"userid"}, Length: 30, Masker: masking.SimplePhoneMasker},
+	}, masking.MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the case-sensitive rule keeps the key in its exact case.
+	if !report.Empty() {
+		t.Fatalf("got %s, expect no diagnostic", report)
+	}
+	b, _ = masking.Mask([]byte(src), math.MaxInt)
+	if string(b) != "UserID:138****5678, userid:138****5678" {
+		t.Fatalf("got %s", b)
+	}
+
+	// the key is handed over to the case-sensitive rule.
+	if err = masking.RemoveKeys("cs_lower", "userid"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ = masking.Mask([]byte(src), math.MaxInt)
+	if string(b) != "UserID:138****5678, userid:13812345678" {
+		t.Fatalf("got %s", b)
+	}
+
+	// updating another field keeps the flag.
+	if err = masking.MergeRules(map[string]*masking.Rule{"cs_upper": {Desc: "user id"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := masking.DumpTrie(); !slices.Contains(keys, "UserID") {
+		t.Fatalf("got %v, expect UserID", keys)
+	}
+
+	// the flag can be cleared by replacing the rule and set again, the keys
+	// keep their case.
+	for _, c := range []struct {
+		caseSensitive bool
+		key           string
+		want          string
+	}{
+		{false, "userid", "UserID:138****5678, userid:138****5678"},
+		{true, "UserID", "UserID:138****5678, userid:13812345678"},
+	} {
+		_, err = masking.MergeRulesReport(map[string]*masking.Rule{
+			"cs_upper": {Keys: []string{"UserID"}, Length: 30, Masker: masking.SimplePhoneMasker, CaseSensitive: c.caseSensitive},
+		}, masking.MergeOptions{Replace: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if keys := masking.DumpTrie(); !slices.Contains(keys, c.key) {
+			t.Fatalf("got %v, expect %s", keys, c.key)
+		}
+		b, _ = masking.Mask([]byte(src), math.MaxInt)
+		if string(b) != c.want {
+			t.Fatalf("got %s, expect %s", b, c.want)
+		}
+	}
+}
+
+func TestCaseSensitiveOwners(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+
+	// redact masks the whole value, so the rule masking a line can be told.
+	redact := func(b []byte) {
+		for i := range b {
+			if b[i] >= '0' && b[i] <= '9' {
+				b[i] = '#'
+			}
+		}
+	}
+	report, err := masking.MergeRulesReport(map[string]*masking.Rule{
+		"cs_id":       {Keys: []string{"ID"}, Length: 12, Masker: redact, CaseSensitive: true},
+		"ci_id":       {Keys: []string{"id"}, Length: 12, Masker: masking.SimplePhoneMasker},
+		"cs_token":    {Keys: []string{"Token"}, Length: 12, Masker: redact, CaseSensitive: true},
+		"cs_token_lc": {Keys: []string{"token"}, Length: 12, Masker: masking.SimplePhoneMasker, CaseSensitive: true},
+	}, masking.MergeOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !report.Empty() {
+		t.Fatalf("got %s, expect no diagnostic", report)
+	}
+
+	src := "ID:13812345678\nid:13812345678\nId:13812345678\nToken:13812345678\ntoken:13812345678\nTOKEN:13812345678"
+	want := "ID:###########\nid:138****5678\nId:138****5678\nToken:###########\ntoken:138****5678\nTOKEN:13812345678"
+	b, _ := masking.Mask([]byte(src), math.MaxInt)
+	if string(b) != want {
+		t.Fatalf("got %q, expect %q", b, want)
+	}
+	rules := masking.DumpTrieRules()
+	if rules["ID"] != "cs_id" || rules["id"] != "ci_id" || rules["Token"] != "cs_token" || rules["token"] != "cs_token_lc" {
+		t.Fatalf("got %v", rules)
+	}
+
+	// removing the key of a rule keeps the key of the other case.
+	if err = masking.RemoveKeys("cs_id", "ID"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ = masking.Mask([]byte("ID:13812345678"), math.MaxInt)
+	if string(b) != "ID:138****5678" {
+		t.Fatalf("got %s, expect masked by ci_id", b)
+	}
+}
+
 func BenchmarkMask(b *testing.B) {
 	testMergeRules(b)
 
@@ -259,3 +1279,35 @@ func BenchmarkMask(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkMaskPriority is like BenchmarkMask, but a rule has a priority,
+// so the keys of higher priorities are looked for on every failed walk.
+func BenchmarkMaskPriority(b *testing.B) {
+	testMergeRules(b)
+	restoreRules(b)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"vip": {
+			Keys:     []string{"*_vip_phone", "vip_*", "*_phone"},
+			Length:   30,
+			Masker:   masking.SimplePhoneMasker,
+			Priority: 1,
+		},
+	})
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, name := range []string{"50K.txt", "300K.txt"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				src := bytes.Clone(data)
+				masking.Mask(src, math.MaxInt)
+			}
+		})
+	}
+}
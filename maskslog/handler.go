@@ -0,0 +1,141 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package maskslog provides a log/slog Handler that masks the messages
+// and the attributes before passing them to the wrapped handler.
+package maskslog
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/lvan100/go-masking"
+)
+
+// Options configures a Handler.
+type Options struct {
+	Limits masking.Limits // budget of masking each message
+}
+
+// Handler is a slog.Handler that masks the values of the attributes whose
+// keys match the rules, and masks the messages as free text. The key of a
+// nested attribute is prefixed with its group path, e.g. "user.phone".
+type Handler struct {
+	h      slog.Handler
+	opts   Options
+	prefix string // group path opened by WithGroup, joined by '.'
+}
+
+// NewHandler returns a Handler that masks the records and passes them to h.
+func NewHandler(h slog.Handler, opts Options) *Handler {
+	return &Handler{h: h, opts: opts}
+}
+
+// Enabled implements slog.Handler.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+// Handle implements slog.Handler. The record is passed to the wrapped
+// handler as is if nothing is masked, otherwise a new record is built.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	msg, changed := h.maskMessage(r.Message)
+	var buf [8]slog.Attr
+	attrs := buf[:0]
+	r.Attrs(func(a slog.Attr) bool {
+		a, c := maskAttr(h.prefix, a)
+		attrs = append(attrs, a)
+		changed = changed || c
+		return true
+	})
+	if !changed {
+		return h.h.Handle(ctx, r)
+	}
+	nr := slog.NewRecord(r.Time, r.Level, msg, r.PC)
+	nr.AddAttrs(attrs...)
+	return h.h.Handle(ctx, nr)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	masked := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		masked[i], _ = maskAttr(h.prefix, a)
+	}
+	return &Handler{h: h.h.WithAttrs(masked), opts: h.opts, prefix: h.prefix}
+}
+
+// WithGroup implements slog.Handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &Handler{h: h.h.WithGroup(name), opts: h.opts, prefix: join(h.prefix, name)}
+}
+
+// maskMessage masks the message as free text.
+func (h *Handler) maskMessage(msg string) (string, bool) {
+	if msg == "" {
+		return msg, false
+	}
+	b, _ := masking.MaskLimits(context.Background(), []byte(msg), h.opts.Limits)
+	if string(b) == msg {
+		return msg, false
+	}
+	return string(b), true
+}
+
+// maskAttr masks the value of the attribute if its key matches a rule,
+// and masks the attributes of a group recursively.
+func maskAttr(prefix string, a slog.Attr) (slog.Attr, bool) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		path := prefix
+		if a.Key != "" { // an empty key inlines the group
+			path = join(prefix, a.Key)
+		}
+		group := v.Group()
+		var masked []slog.Attr
+		for i, g := range group {
+			g, c := maskAttr(path, g)
+			if c && masked == nil {
+				masked = append([]slog.Attr(nil), group...)
+			}
+			if masked != nil {
+				masked[i] = g
+			}
+		}
+		if masked == nil {
+			return a, false
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(masked...)}, true
+	}
+	key := join(prefix, a.Key)
+	if !masking.MatchKey(key) {
+		return a, false
+	}
+	b := []byte(v.String())
+	if _, changed := masking.MaskValue(key, b); !changed {
+		return a, false
+	}
+	return slog.String(a.Key, string(b)), true
+}
+
+// join joins the group path and the key with '.'.
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package maskslog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"testing/slogtest"
+
+	"github.com/lvan100/go-masking"
+	"github.com/lvan100/go-masking/maskslog"
+)
+
+func init() {
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"phone": {
+			Desc:   "手机号",
+			Keys:   []string{"cell", "phone", "*_phone"},
+			Length: 30,
+			Masker: masking.SimplePhoneMasker,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func newLogger(buf *bytes.Buffer) *slog.Logger {
+	h := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return slog.New(maskslog.NewHandler(h, maskslog.Options{}))
+}
+
+func TestHandler(t *testing.T) {
+	testCases := []struct {
+		log  func(l *slog.Logger)
+		want string
+	}{
+		{
+			log: func(l *slog.Logger) {
+				l.Info("nothing to mask", "name", "bob", "phone", "unknown")
+			},
+			want: `level=INFO msg="nothing to mask" name=bob phone=unknown`,
+		},
+		{
+			log: func(l *slog.Logger) {
+				l.Info("login cell:12345678900", "phone", "12345678900", "driver_phone", 12345678900)
+			},
+			want: `level=INFO msg="login cell:123****8900" phone=123****8900 driver_phone=123****8900`,
+		},
+		{
+			log: func(l *slog.Logger) {
+				l.Info("nested", slog.Group("user", "name", "bob", "cell", "12345678900",
+					slog.Group("contact", "phone", "12345678900")))
+			},
+			want: `level=INFO msg=nested user.name=bob user.cell=123****8900 user.contact.phone=123****8900`,
+		},
+		{
+			log: func(l *slog.Logger) {
+				l.With("cell", "12345678900").WithGroup("req").Info("with", "phone", "12345678900", "id", 1)
+			},
+			want: `level=INFO msg=with cell=123****8900 req.phone=123****8900 req.id=1`,
+		},
+		{
+			log: func(l *slog.Logger) {
+				l.WithGroup("phone").Info("group path", "name", "12345678900")
+			},
+			want: `level=INFO msg="group path" phone.name=12345678900`,
+		},
+	}
+	for i, tt := range testCases {
+		var buf bytes.Buffer
+		tt.log(newLogger(&buf))
+		if got := strings.TrimSpace(buf.String()); got != tt.want {
+			t.Errorf("%d: got %s, expect %s", i, got, tt.want)
+		}
+	}
+}
+
+func TestHandlerConformance(t *testing.T) {
+	var buf bytes.Buffer
+	h := maskslog.NewHandler(slog.NewJSONHandler(&buf, nil), maskslog.Options{})
+	err := slogtest.TestHandler(h, func() []map[string]any {
+		var ms []map[string]any
+		for _, line := range bytes.Split(buf.Bytes(), []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			var m map[string]any
+			if err := json.Unmarshal(line, &m); err != nil {
+				t.Fatal(err)
+			}
+			ms = append(ms, m)
+		}
+		return ms
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
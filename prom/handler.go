@@ -0,0 +1,132 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prom exports the masking statistics in the Prometheus text
+// exposition format, using only the standard library.
+package prom
+
+import (
+	"bufio"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lvan100/go-masking"
+)
+
+// reasons are the stop reasons exported, StopNone is not an interception.
+var reasons = []masking.StopReason{
+	masking.StopDeadline,
+	masking.StopCanceled,
+	masking.StopPanic,
+	masking.StopByteLimit,
+	masking.StopMatchLimit,
+}
+
+// NewHandler returns a http.Handler that renders the snapshot of the
+// counters in the Prometheus text exposition format. All merged rules
+// are exported, even if they have never been hit.
+func NewHandler(c *masking.Counters) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		write(buf, c.Snapshot(), masking.RuleNames())
+		_ = buf.Flush()
+	})
+}
+
+// write renders the snapshot in the Prometheus text exposition format.
+func write(w *bufio.Writer, s masking.CountersSnapshot, ruleNames []string) {
+
+	// appends the rules which have been hit but not merged,
+	// e.g. the rules removed after being hit.
+	names := make(map[string]struct{})
+	for _, name := range ruleNames {
+		names[name] = struct{}{}
+	}
+	for name := range s.Rules {
+		if _, ok := names[name]; !ok {
+			ruleNames = append(ruleNames, name)
+		}
+	}
+	slices.Sort(ruleNames)
+
+	header(w, "masking_rule_hits_total", "counter", "Number of the matches found by rule.")
+	for _, name := range ruleNames {
+		sample(w, "masking_rule_hits_total", label("rule", name), s.Rules[name].Hits)
+	}
+
+	header(w, "masking_rule_masked_total", "counter", "Number of the maskers applied by rule and whether the bytes changed.")
+	for _, name := range ruleNames {
+		sample(w, "masking_rule_masked_total", label("rule", name)+","+label("changed", "true"), s.Rules[name].Changed)
+		sample(w, "masking_rule_masked_total", label("rule", name)+","+label("changed", "false"), s.Rules[name].Unchanged)
+	}
+
+	header(w, "masking_rule_panics_total", "counter", "Number of the masker panics by rule.")
+	for _, name := range ruleNames {
+		sample(w, "masking_rule_panics_total", label("rule", name), s.Rules[name].Panics)
+	}
+
+	header(w, "masking_panics_total", "counter", "Number of all panics recovered.")
+	sample(w, "masking_panics_total", "", s.Panics)
+
+	header(w, "masking_intercepted_total", "counter", "Number of the interrupted masking operations by reason.")
+	for _, reason := range reasons {
+		sample(w, "masking_intercepted_total", label("reason", reason.String()), s.Intercepted[reason.String()])
+	}
+
+	header(w, "masking_duration_seconds", "histogram", "Latency of the masking operations.")
+	var cumulative int64
+	for i, bound := range s.Latency.Bounds {
+		cumulative += s.Latency.Counts[i]
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		sample(w, "masking_duration_seconds_bucket", label("le", le), cumulative)
+	}
+	// the +Inf bucket and the count are derived from the same buckets,
+	// the count loaded separately may lag behind them.
+	for _, n := range s.Latency.Counts[len(s.Latency.Bounds):] {
+		cumulative += n
+	}
+	sample(w, "masking_duration_seconds_bucket", label("le", "+Inf"), cumulative)
+	w.WriteString("masking_duration_seconds_sum ")
+	w.WriteString(strconv.FormatFloat(s.Latency.Sum.Seconds(), 'g', -1, 64))
+	w.WriteByte('\n')
+	sample(w, "masking_duration_seconds_count", "", cumulative)
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func header(w *bufio.Writer, name, typ, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes a sample line of a metric.
+func sample(w *bufio.Writer, name, labels string, v int64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatInt(v, 10))
+	w.WriteByte('\n')
+}
+
+// labelEscaper escapes the label values as the exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label returns a label pair with the escaped value.
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prom_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lvan100/go-masking"
+	"github.com/lvan100/go-masking/prom"
+)
+
+func TestHandler(t *testing.T) {
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"phone": {
+			Desc:   "手机号",
+			Keys:   []string{"cell", "phone"},
+			Length: 30,
+			Masker: masking.SimplePhoneMasker,
+		},
+		"id": {
+			Desc:   "身份证号",
+			Keys:   []string{"id_card"},
+			Length: 30,
+			Masker: masking.SimpleIdMasker,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := masking.NewCounters()
+	masking.SetObserver(c)
+	defer masking.SetObserver(nil)
+
+	masking.Mask([]byte("cell:12345678900, phone:123"), 2000)
+	masking.MaskLimits(context.Background(), []byte("cell:1, phone:2"), masking.Limits{MaxMatches: 1})
+
+	server := httptest.NewServer(prom.NewHandler(c))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body := string(b)
+
+	for _, line := range []string{
+		"# TYPE masking_rule_hits_total counter",
+		`masking_rule_hits_total{rule="id"} 0`,
+		`masking_rule_hits_total{rule="phone"} 3`,
+		`masking_rule_masked_total{rule="phone",changed="true"} 1`,
+		`masking_rule_masked_total{rule="phone",changed="false"} 2`,
+		`masking_rule_panics_total{rule="phone"} 0`,
+		"masking_panics_total 0",
+		`masking_intercepted_total{reason="deadline"} 0`,
+		`masking_intercepted_total{reason="match-limit"} 1`,
+		"# TYPE masking_duration_seconds histogram",
+		`masking_duration_seconds_bucket{le="1e-06"} `,
+		`masking_duration_seconds_bucket{le="+Inf"} 2`,
+		"masking_duration_seconds_count 2",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("expect %q in\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prom
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvan100/go-masking"
+)
+
+func TestWriteHistogramMonotonic(t *testing.T) {
+	s := masking.CountersSnapshot{
+		Latency: masking.Histogram{
+			Bounds: []time.Duration{time.Microsecond, time.Millisecond},
+			Counts: []int64{2, 3, 1},
+			Count:  4, // loaded before the last observations are counted
+		},
+	}
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	write(w, s, nil)
+	_ = w.Flush()
+	for _, line := range []string{
+		`masking_duration_seconds_bucket{le="0.001"} 5`,
+		`masking_duration_seconds_bucket{le="+Inf"} 6`,
+		"masking_duration_seconds_count 6",
+	} {
+		if !strings.Contains(sb.String(), line) {
+			t.Errorf("expect %q in\n%s", line, sb.String())
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking
+
+import (
+	"context"
+	"io"
+	"slices"
+
+	"github.com/lvan100/go-masking/internal"
+)
+
+const (
+	readerChunkSize  = 4096      // bytes read from the underlying reader each time
+	readerMaxPending = 64 * 1024 // bytes buffered before a forced split
+	readerContext    = 3         // bytes kept before the split point, e.g. %22
+)
+
+// StopError is returned by Reader.Read when masking the read bytes stopped
+// early. The intercept policy has been applied to the bytes read before it,
+// and the rest of the underlying reader is not read.
+type StopError struct {
+	Reason StopReason
+}
+
+func (e *StopError) Error() string {
+	return "masking stopped: " + e.Reason.String()
+}
+
+// Reader is an io.Reader that masks the bytes read from the underlying
+// reader. The input doesn't need to be newline-delimited, the keys and
+// the values split across the read boundaries are still detected.
+type Reader struct {
+	r      io.Reader
+	limits Limits // budget of masking each processed piece
+	buf    []byte // the context bytes followed by the pending bytes
+	skip   int    // number of the context bytes, which have been read out
+	out    []byte // the masked bytes to be read out
+	obuf   []byte // backing array of out
+	err    error
+}
+
+// NewReader returns a Reader that masks the bytes read from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// NewReaderLimits returns a Reader that masks the bytes read from r, each
+// processed piece within the limits.
+func NewReaderLimits(r io.Reader, l Limits) *Reader {
+	return &Reader{r: r, limits: l}
+}
+
+// Read reads the masked bytes into p. It returns a *StopError after the
+// masked bytes if masking stopped early, e.g. a masker panicked.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads a chunk from the underlying reader, and masks the bytes that
+// can't be affected by the following bytes anymore.
+func (r *Reader) fill() {
+	n := len(r.buf)
+	r.buf = slices.Grow(r.buf, readerChunkSize)
+	m, err := r.r.Read(r.buf[n : n+readerChunkSize])
+	r.buf = r.buf[:n+m]
+	if err != nil {
+		r.err = err
+		r.process(len(r.buf))
+		return
+	}
+	limit := len(r.buf) - carryLength()
+	if limit <= r.skip {
+		return
+	}
+	if cut := splitPoint(r.buf, r.skip, limit); cut > 0 {
+		r.process(cut)
+	} else if limit-r.skip >= readerMaxPending {
+		r.process(limit)
+	}
+}
+
+// carryLength returns the number of bytes carried over to the next piece,
+// which may contain a key and its value, the +2 covers the end splitter
+// and the walk failure after a key.
+func carryLength() int {
+	return internal.MaxWindow() + 2
+}
+
+// splitPoint returns the last split point in b after from and not after
+// limit, the byte before which can't be part of a key, so the trie walk is
+// always restarted there. It returns zero if no split point is found.
+func splitPoint(b []byte, from, limit int) int {
+	for i := limit; i > from; i-- {
+		if !internal.IsKeyChar(b[i-1]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// process masks the pending bytes before cut, which are read out then,
+// and keeps a few bytes before cut as the context of the following keys.
+// If masking stops early, the Reader fails with a *StopError.
+func (r *Reader) process(cut int) {
+	var res internal.MaskResult
+	budget := internal.NewLimitsBudget(context.Background(), r.limits)
+	b := internal.MaskRangeBudget(r.buf, r.skip, cut, budget, &res)
+	r.obuf = append(r.obuf[:0], b...)
+	r.out = r.obuf
+	if res.Reason != internal.StopNone {
+		r.err = &StopError{Reason: res.Reason}
+		r.buf, r.skip = r.buf[:0], 0
+		return
+	}
+	start := max(cut-readerContext, 0)
+	r.buf = r.buf[:copy(r.buf, r.buf[start:])]
+	r.skip = cut - start
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/lvan100/go-masking"
+)
+
+func TestReader(t *testing.T) {
+	testMergeRules(t)
+
+	src := strings.Repeat("abc cell:12345678900, %22phone%22:12345678900,xcell:12345678900 ", 100)
+	want := strings.Repeat("abc cell:123****8900, %22phone%22:123****8900,xcell:12345678900 ", 100)
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"plain":    func(r io.Reader) io.Reader { return r },
+		"one-byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data-err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		b, err := io.ReadAll(masking.NewReader(wrap(strings.NewReader(src))))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if string(b) != want {
+			t.Errorf("%s: got %q, expect %q", name, b, want)
+		}
+	}
+
+	if err := iotest.TestReader(masking.NewReader(strings.NewReader(src)), []byte(want)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderFile(t *testing.T) {
+	testMergeRules(t)
+
+	src, err := os.ReadFile(filepath.Join("testdata", "50K.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "Masked_50K.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(masking.NewReader(iotest.OneByteReader(bytes.NewReader(src))))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("NewReader() = %s, want %s", got, want)
+	}
+}
+
+func TestReaderPanic(t *testing.T) {
+	testMergeRules(t)
+	restoreRules(t)
+
+	err := masking.MergeRules(map[string]*masking.Rule{
+		"broken": {
+			Keys:   []string{"broken_key"},
+			Length: 30,
+			Masker: func(b []byte) { panic("broken") },
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the window of the panicking masker and the rest are redacted.
+	src := "cell:12345678900, broken_key:12345678900, phone:12345678900"
+	want := "cell:123****8900, broken_key" + strings.Repeat("*", len(src)-len("cell:12345678900, broken_key"))
+	b, err := io.ReadAll(masking.NewReader(strings.NewReader(src)))
+	var e *masking.StopError
+	if !errors.As(err, &e) || e.Reason != masking.StopPanic {
+		t.Fatalf("got error %v, expect a panic stop", err)
+	}
+	if string(b) != want {
+		t.Errorf("got %q, expect %q", b, want)
+	}
+
+	// the stop is reported once the masked bytes are read out.
+	r := masking.NewReaderLimits(strings.NewReader(strings.Repeat(src+" ", 1000)), masking.Limits{})
+	n, err := io.Copy(io.Discard, r)
+	if !errors.As(err, &e) || n == 0 {
+		t.Fatalf("got %d bytes and error %v, expect a panic stop", n, err)
+	}
+	if _, err = r.Read(make([]byte, 16)); !errors.As(err, &e) {
+		t.Errorf("got error %v, expect the stop error again", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/lvan100/go-masking/internal"
+)
+
+// DefaultMaxLineLength is the default maximum line length of Writer.
+const DefaultMaxLineLength = 64 * 1024
+
+// ErrWriterClosed is returned when writing to a closed Writer.
+var ErrWriterClosed = errors.New("writer is closed")
+
+// OverlongPolicy defines how Writer handles the lines longer than
+// the maximum line length.
+type OverlongPolicy int
+
+const (
+	OverlongSplit    OverlongPolicy = iota // masks and writes the line piece by piece, carrying the context between pieces
+	OverlongTruncate                       // masks the first piece with the lookahead of a match, writes it cut at the limit, discards the rest
+	OverlongDrop                           // discards the whole line
+)
+
+// WriterOptions configures a Writer. Under OverlongSplit, the bytes of the
+// longest match are carried to the next piece besides MaxLineLength, so a
+// key and its value split across the pieces are still masked. Likewise,
+// under OverlongTruncate, a value crossing the cut is masked before the
+// line is cut.
+type WriterOptions struct {
+	Limits        Limits         // budget of masking each line or piece
+	MaxLineLength int            // zero means DefaultMaxLineLength
+	Overlong      OverlongPolicy // how to handle the overlong lines
+}
+
+// Writer is an io.Writer that masks the written bytes line by line and
+// forwards them to the underlying writer. The partial line is buffered
+// until its newline is written, or Flush or Close is called. It is safe
+// for concurrent use.
+type Writer struct {
+	mutex      sync.Mutex
+	w          io.Writer
+	opts       WriterOptions
+	buf        []byte // the context bytes followed by the partial line
+	skip       int    // number of the context bytes, which have been written
+	out        []byte // the masked bytes to be forwarded
+	discarding bool   // whether discarding the rest of an overlong line
+	closed     bool
+}
+
+// NewWriter returns a Writer that masks the lines and forwards them to w.
+func NewWriter(w io.Writer, opts WriterOptions) *Writer {
+	if opts.MaxLineLength <= 0 {
+		opts.MaxLineLength = DefaultMaxLineLength
+	}
+	return &Writer{w: w, opts: opts}
+}
+
+// Write masks the complete lines in p and forwards them to the underlying
+// writer, and buffers the partial line at the end. The bytes of p are
+// consumed even if the underlying writer fails, the output it didn't write
+// is kept and forwarded again by the next Write, Flush or Close.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.appendPartial(p)
+			break
+		}
+		w.appendPartial(p[:i])
+		w.endLine()
+		p = p[i+1:]
+	}
+	return n, w.forward()
+}
+
+// Flush masks the buffered partial line, and forwards it to the underlying
+// writer without a newline.
+func (w *Writer) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	return w.flush()
+}
+
+// Close flushes the buffered partial line. It doesn't close the underlying
+// writer, and the Writer can't be written after closed.
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	if !w.discarding && len(w.buf) > w.skip {
+		w.emit(len(w.buf))
+	}
+	w.buf, w.skip = w.buf[:0], 0
+	w.discarding = false
+	return w.forward()
+}
+
+// appendPartial appends the bytes without newline to the partial line,
+// and handles the line when it becomes overlong.
+func (w *Writer) appendPartial(p []byte) {
+	for !w.discarding {
+		carry := 0
+		if w.opts.Overlong != OverlongDrop {
+			carry = carryLength()
+		}
+		room := max(w.opts.MaxLineLength+carry-(len(w.buf)-w.skip), 0)
+		if len(p) <= room {
+			w.buf = append(w.buf, p...)
+			return
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+		switch w.opts.Overlong {
+		case OverlongTruncate:
+			w.emit(len(w.buf))
+			w.discarding = true
+		case OverlongDrop:
+			w.discarding = true
+		default:
+			w.split(carry)
+			continue
+		}
+		w.buf, w.skip = w.buf[:0], 0
+	}
+}
+
+// split masks and writes the overlong line before the last split point,
+// and carries the rest, which may contain a key and its value, to the next
+// piece, along with a few bytes before the split point as the context.
+func (w *Writer) split(carry int) {
+	limit := len(w.buf) - carry
+	cut := splitPoint(w.buf, w.skip, limit)
+	if cut == 0 {
+		cut = limit
+	}
+	w.emit(cut)
+	start := max(cut-readerContext, 0)
+	w.buf = w.buf[:copy(w.buf, w.buf[start:])]
+	w.skip = cut - start
+}
+
+// endLine handles the end of a line.
+func (w *Writer) endLine() {
+	if w.discarding {
+		w.discarding = false
+		if w.opts.Overlong == OverlongDrop {
+			return
+		}
+	} else {
+		w.emit(len(w.buf))
+		w.buf, w.skip = w.buf[:0], 0
+	}
+	w.out = append(w.out, '\n')
+}
+
+// emit masks the pending bytes of the line before cut in-place, and appends
+// them to the output. Under OverlongTruncate, the masked line is cut at the
+// maximum line length.
+func (w *Writer) emit(cut int) {
+	var r internal.MaskResult
+	budget := internal.NewLimitsBudget(context.Background(), w.opts.Limits)
+	b := internal.MaskRangeBudget(w.buf, w.skip, cut, budget, &r)
+	if w.opts.Overlong == OverlongTruncate && len(b) > w.opts.MaxLineLength {
+		b = b[:w.opts.MaxLineLength]
+	}
+	w.out = append(w.out, b...)
+}
+
+// forward writes the output to the underlying writer, and keeps the bytes
+// it didn't write.
+func (w *Writer) forward() error {
+	if len(w.out) == 0 {
+		return nil
+	}
+	n, err := w.w.Write(w.out)
+	w.out = w.out[:copy(w.out, w.out[n:])]
+	return err
+}
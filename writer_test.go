@@ -0,0 +1,186 @@
+// Copyright 2024 github.com/lvan100
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package masking_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/lvan100/go-masking"
+)
+
+func TestWriter(t *testing.T) {
+	testMergeRules(t)
+
+	var buf bytes.Buffer
+	w := masking.NewWriter(&buf, masking.WriterOptions{})
+	for _, s := range []string{"cel", "l:1234567", "8900\nphone:12345678900\nmobile:", "12345678900"} {
+		n, err := w.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("Write() = %d, %v", n, err)
+		}
+	}
+	if want := "cell:123****8900\nphone:123****8900\n"; buf.String() != want {
+		t.Fatalf("got %q, expect %q", buf.String(), want)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "cell:123****8900\nphone:123****8900\nmobile:123****8900"; buf.String() != want {
+		t.Fatalf("got %q, expect %q", buf.String(), want)
+	}
+	if _, err := w.Write([]byte("x")); err != masking.ErrWriterClosed {
+		t.Fatalf("got error %v, expect %v", err, masking.ErrWriterClosed)
+	}
+
+	buf.Reset()
+	logger := log.New(masking.NewWriter(&buf, masking.WriterOptions{}), "", 0)
+	logger.Printf("user login, cell:%s", "12345678900")
+	if want := "user login, cell:123****8900\n"; buf.String() != want {
+		t.Fatalf("got %q, expect %q", buf.String(), want)
+	}
+}
+
+// failingWriter writes at most limit bytes, and fails if it writes less.
+type failingWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.limit {
+		return w.Buffer.Write(p)
+	}
+	n, _ := w.Buffer.Write(p[:w.limit])
+	return n, errors.New("short write")
+}
+
+func TestWriterFailure(t *testing.T) {
+	testMergeRules(t)
+
+	fw := &failingWriter{limit: 5}
+	w := masking.NewWriter(fw, masking.WriterOptions{})
+	s := "cell:12345678900\n"
+	if n, err := w.Write([]byte(s)); err == nil || n != len(s) {
+		t.Fatalf("Write() = %d, %v, expect the bytes consumed and the error", n, err)
+	}
+	// the output not written is forwarded again.
+	fw.limit = math.MaxInt
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "cell:123****8900\n"; fw.String() != want {
+		t.Fatalf("got %q, expect %q", fw.String(), want)
+	}
+}
+
+func TestWriterOverlong(t *testing.T) {
+	testMergeRules(t)
+
+	const src = "cell:12345678900\nabcdefghijklmnopqrstuvwxyz\nphone:12345678900\n"
+
+	testCases := []struct {
+		policy masking.OverlongPolicy
+		want   string
+	}{
+		{
+			policy: masking.OverlongSplit,
+			want:   "cell:123****8900\nabcdefghijklmnopqrstuvwxyz\nphone:123****8900\n",
+		},
+		{
+			policy: masking.OverlongTruncate,
+			want:   "cell:123****8900\nabcdefghijklmnopqrst\nphone:123****8900\n",
+		},
+		{
+			policy: masking.OverlongDrop,
+			want:   "cell:123****8900\nphone:123****8900\n",
+		},
+	}
+
+	for _, tt := range testCases {
+		var buf bytes.Buffer
+		w := masking.NewWriter(&buf, masking.WriterOptions{
+			MaxLineLength: 20,
+			Overlong:      tt.policy,
+		})
+		for i := 0; i < len(src); i += 7 {
+			if _, err := w.Write([]byte(src[i:min(i+7, len(src))])); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%d: got %q, expect %q", tt.policy, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestWriterOverlongTruncate(t *testing.T) {
+	testMergeRules(t)
+
+	// the values crossing the cut are masked before the line is cut.
+	for _, src := range []string{
+		"phone:13812345678 tail\n",
+		"abc phone:13812345678 tail\n",
+		"phone:13812345678\n",
+	} {
+		want, _ := masking.Mask([]byte(src), math.MaxInt)
+		want = append(want[:16:16], '\n')
+
+		var buf bytes.Buffer
+		w := masking.NewWriter(&buf, masking.WriterOptions{MaxLineLength: 16, Overlong: masking.OverlongTruncate})
+		for i := 0; i < len(src); i += 3 {
+			if _, err := w.Write([]byte(src[i:min(i+3, len(src))])); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != string(want) {
+			t.Fatalf("got %q, expect %q", buf.String(), want)
+		}
+	}
+}
+
+func TestWriterOverlongSplit(t *testing.T) {
+	testMergeRules(t)
+
+	// the keys and the values straddle the piece boundaries at every offset.
+	for pad := 0; pad < 40; pad++ {
+		line := strings.Repeat("a ", pad) + "cell:12345678900, " + strings.Repeat("b", pad) + " phone:12345678900 " + strings.Repeat("c ", 50)
+		want, _ := masking.Mask([]byte(line), math.MaxInt)
+
+		var buf bytes.Buffer
+		w := masking.NewWriter(&buf, masking.WriterOptions{MaxLineLength: 16})
+		for i := 0; i < len(line); i += 5 {
+			if _, err := w.Write([]byte(line[i:min(i+5, len(line))])); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if buf.String() != string(want) {
+			t.Fatalf("%d: got %q, expect %q", pad, buf.String(), want)
+		}
+	}
+}